@@ -33,7 +33,11 @@ import (
    "log"
    "fmt"
    "os"
+   "strings"
+   "path/filepath"
+   "crypto/ed25519"
    "github.com/therecipe/qt/widgets"
+   "github.com/therecipe/qt/core"
    "github.com/therecipe/qt/gui"
 )
 
@@ -49,11 +53,17 @@ func Run () {
    app := widgets.NewQApplication(len(os.Args), os.Args)
 	app.ConnectAboutToQuit(func () {
 		qMain.EndScan()
+		qMain.closeView()
 		Config.Save()
 	})
    ParseOptions()
    qMain = NewMainWindow(nil, 0)
    qMain.Show()
+   if Opt.Verify != "" { qMain.BeginVerify(Opt.Verify) } else if Opt.Output != "" {
+      qMain.beginScan(true)
+   }
+   // A manifest check without '-o' shows its results, as from the menu
+   if Opt.Output == "" { qMain.batch = false }
    app.Exec()
 }
 
@@ -72,16 +82,30 @@ type MainWindow struct {
 	errors		chan error
 	abort			chan bool
 	scanState	int
+	batch			bool		// running the scan or check asked for on the command line
+	exported		chan error
+	exportName	string		// "report" or "patch", for messages
+	
+	views			chan *ViewResult
+	viewStop		chan bool
+	viewing		bool
+	viewConn,
+	sourceConn	FTPConn		// to a remote source, if any
+	cancel		*widgets.QPushButton
+	bandwidth	*widgets.QSpinBox
    
    _ func() `constructor:"init"`
 	_ func(string) `signal:"ShowStatus"`
 	_ func() `signal:"ScanComplete"`
+	_ func() `signal:"ViewReady"`
+	_ func() `signal:"ExportDone"`
 }
 
 const (
 	Scanner__Idle = iota
 	Scanner__Active
 	Scanner__Stopping
+	Scanner__Exporting
 )
 
 /* init
@@ -90,6 +114,7 @@ const (
 */
 
 func (w *MainWindow) init () {
+   w.batch = Opt.Output != "" || Opt.Verify != ""
    w.report = NewReportView(w)
    w.SetCentralWidget(w.report)
    
@@ -118,12 +143,32 @@ func (w *MainWindow) init () {
    tools.InsertAction(nil, act)
    act.ConnectTriggered(w.resetScan)
    
+   act = menu.AddAction("Verify Manifest")
+   act.ConnectTriggered(w.verifyManifest)
+   
    menu = menuBar.AddMenu2("&Report")
    doView := menu.AddAction2(gui.NewQIcon5(":/images/preview.png"), "View Changes")
    tools.InsertAction(nil, doView)
    doView.ConnectTriggered(w.viewSelected)
    doView.SetEnabled(false)
    
+   treeView := menu.AddAction("Tree View")
+   treeView.SetCheckable(true)
+   treeView.ConnectTriggered(func (checked bool) {
+      Config.TreeView = checked
+      w.report.SetModel(ShowResults(w.cache))
+   })
+   menu.ConnectAboutToShow(func () { treeView.SetChecked(Config.TreeView) })
+   
+   act = menu.AddAction("Export Report")
+   act.ConnectTriggered(w.exportReport)
+   
+   act = menu.AddAction("Export Patch")
+   act.ConnectTriggered(w.exportPatch)
+   
+   act = menu.AddAction("Export Manifest")
+   act.ConnectTriggered(w.exportManifest)
+   
    menu = menuBar.AddMenu2("&Help")
    act = menu.AddAction("About")
    act.ConnectTriggered(w.showVersion)
@@ -132,12 +177,42 @@ func (w *MainWindow) init () {
    act.ConnectTriggered(w.showUsage)
    
    w.report.ConnectRowSelected(func (yes bool) { doView.SetEnabled(yes) })
+   
+   filter := NewReportFilter(nil, 0)
+   tools.AddSeparator()
+   tools.AddWidget(filter)
+   filter.ConnectChanged(func () { filter.Apply(w.report) })
+   w.report.ConnectFolderChosen(filter.ShowFolder)
+   w.report.ConnectFolderExported(w.savePatch)
 	
 	w.ConnectShowStatus(w.showStatus)
 	w.ConnectScanComplete(w.scanComplete)
 	w.errors = make(chan error, 1)
 	w.abort = make(chan bool, 1)
 	w.scanState = Scanner__Idle
+	
+	w.ConnectExportDone(w.exportDone)
+	w.exported = make(chan error, 1)
+	
+	w.ConnectViewReady(w.viewReady)
+	w.views = make(chan *ViewResult, 1)
+	w.viewStop = make(chan bool, 1)
+	w.cancel = widgets.NewQPushButton2("Cancel", nil)
+	w.cancel.ConnectClicked(func (bool) {
+		select { case w.viewStop <- true: default: }
+	})
+	w.StatusBar().AddPermanentWidget(w.cancel, 0)
+	w.cancel.Hide()
+	
+	w.bandwidth = widgets.NewQSpinBox(nil)
+	w.bandwidth.SetRange(0, 1000000)
+	w.bandwidth.SetSingleStep(64)
+	w.bandwidth.SetPrefix("Limit: ")
+	w.bandwidth.SetSuffix(" KB/s")
+	w.bandwidth.SetSpecialValueText("No limit")
+	w.bandwidth.SetToolTip("Bandwidth limit for transfers; may be changed during a scan")
+	w.bandwidth.ConnectValueChanged(SetBandwidthLimit)
+	w.StatusBar().AddPermanentWidget(w.bandwidth, 0)
    
    w.StatusBar()
    w.SetWindowIcon(gui.NewQIcon5(":/images/search.png"))
@@ -183,6 +258,8 @@ func (w *MainWindow) refresh () {
 	title := gui.QGuiApplication_ApplicationDisplayName()
 	if Config.Source != "" { title = fmt.Sprintf("%s - %s", Config.Name, title) }
 	w.SetWindowTitle(title)
+	w.closeView()
+	w.showBandwidth()
    
    if Config.Source == "" {
       w.cache = NewCache()
@@ -190,33 +267,204 @@ func (w *MainWindow) refresh () {
    } else {
       var err error
       w.cache, err = LoadCache()
-      if err != nil { w.showError("Load cache", err); return }
+      if err != nil { w.startError("Load cache", err); return }
       w.report.SetModel(ShowResults(w.cache))
    }
 }
 
+/* showBandwidth
+**    Applies the bandwidth limit in force, after a change to the site, and
+** shows it in the status bar.
+*/
+
+func (w *MainWindow) showBandwidth () {
+	Throttle.SetRate(BandwidthLimit())
+	w.bandwidth.BlockSignals(true)
+	w.bandwidth.SetValue(BandwidthLimit())
+	w.bandwidth.BlockSignals(false)
+}
+
 /* beginScan
 **    Handles the menu item to begin a new scan.
 */
 
 func (w *MainWindow) beginScan (bool) {
 	if w.scanState != Scanner__Idle { return }
+   if w.cache.Transient() { w.refresh() }
    err := Config.Check()
    if err == nil {
       if Opt.Verbose {
          log.Println("Starting scan...")
-         log.Printf("  Local folder: %s\n", Config.Source)
+         log.Printf("  Local folder: %s\n", sourceName())
          log.Printf("  Cache file:   %s\n", Config.CacheFile)
          log.Printf("  Exclude:      %v\n", Config.Exclude)
          log.Printf("  Binary:       %v\n", Config.BinaryFiles)
          log.Printf("  Remote addr:  %s\n", Config.RemoteAddr.String())
          log.Printf("  Server key:   %x\n", Config.ServerKey)
+         log.Printf("  Bandwidth:    %d KB/s\n", BandwidthLimit())
+         for _, pin := range Config.CertPins {
+            log.Printf("  Pinned key:   %s\n", pin.Fingerprint())
+         }
       }
 		w.scanState = Scanner__Active
       go ScanFolders(w.cache, w.errors, w.abort)
    } else {
-		w.showError("Scan", err)
+		w.startError("Scan", err)
+   }
+}
+
+/* verifyManifest
+**    Handles the menu item to check the remote copy against a manifest.
+*/
+
+func (w *MainWindow) verifyManifest (bool) {
+	if w.scanState != Scanner__Idle { return }
+   path := widgets.QFileDialog_GetOpenFileName(
+      w,
+      "Verify Manifest",
+      "",
+      "Manifest files (*.manifest);;All files (*)",
+      "",
+      0,
+   )
+   if path != "" { w.BeginVerify(path) }
+}
+
+/* BeginVerify
+**    Loads the given manifest and starts a scan of the remote copy for the
+** current site, to compare against it. The results are not saved in the
+** site's cache file.
+*/
+
+func (w *MainWindow) BeginVerify (path string) {
+	if w.scanState != Scanner__Idle { return }
+   err := Config.CheckRemote()
+   if err != nil { w.startError("Verify", err); return }
+   
+   m, err := LoadManifest(path)
+   if err != nil { w.startError("Verify", err); return }
+   
+   if Opt.Verbose {
+      log.Println("Starting manifest check...")
+      log.Printf("  Manifest:     %s (%s, %s)\n", path, m.Site, m.Created)
+      log.Printf("  Remote addr:  %s\n", Config.RemoteAddr.String())
+   }
+   
+   w.cache = NewTransientCache()
+   w.report.SetModel(nil)
+	w.scanState = Scanner__Active
+   go VerifyManifest(m, w.cache, w.errors, w.abort)
+}
+
+/* exportPatch
+**    Handles the menu item to save the differences for all changed text
+** files as a single patch.
+*/
+
+func (w *MainWindow) exportPatch (bool) {
+   w.savePatch("")
+}
+
+/* savePatch
+**    Saves the differences for the changed text files in a folder (or in
+** the whole site, if blank) as a single patch.
+*/
+
+func (w *MainWindow) savePatch (folder string) {
+   if w.scanState != Scanner__Idle || w.cache.Transient() { return }
+   name := Config.Name
+   if folder != "" { name += "-" + filepath.Base(folder) }
+   path := widgets.QFileDialog_GetSaveFileName(
+      w,
+      "Export Patch",
+      name + ".patch",
+      "Patch files (*.patch *.diff);;All files (*)",
+      "",
+      0,
+   )
+   if path == "" { return }
+   
+   cache := w.cache
+   w.beginExport("patch", func () error { return SavePatch(cache, folder, path, w.abort) })
+}
+
+/* exportManifest
+**    Handles the menu item to save the local fingerprints from the last scan
+** as a signed manifest.
+*/
+
+func (w *MainWindow) exportManifest (bool) {
+   if w.scanState != Scanner__Idle || w.cache.Transient() { return }
+   path := widgets.QFileDialog_GetSaveFileName(
+      w,
+      "Export Manifest",
+      Config.Name + ".manifest",
+      "Manifest files (*.manifest);;All files (*)",
+      "",
+      0,
+   )
+   if path == "" { return }
+   
+   err := ExportManifest(w.cache, path)
+   if err != nil { w.showError("Export manifest", err); return }
+   
+   key, err := ManifestKey()
+   if err == nil {
+      w.TempStatus("Manifest signed by key " + KeyFingerprint(key.Public().(ed25519.PublicKey)))
+   }
+}
+
+/* exportReport
+**    Handles the menu item to save the results in a machine-readable form.
+** The format is the one chosen in the file dialog's filter.
+*/
+
+func (w *MainWindow) exportReport (bool) {
+   if w.scanState != Scanner__Idle { return }
+   d := widgets.NewQFileDialog2(w, "Export Report", Config.Name + ".json", strings.Join(ReportFilters, ";;"))
+   d.SetAcceptMode(widgets.QFileDialog__AcceptSave)
+   if d.Exec() != int(widgets.QDialog__Accepted) || len(d.SelectedFiles()) == 0 { return }
+   path := d.SelectedFiles()[0]
+   format := ""
+   for n, f := range ReportFilters {
+      if f == d.SelectedNameFilter() { format = ReportFormats[n] }
    }
+   
+   cache := w.cache
+   w.beginExport("report", func () error {
+      return SaveReport(cache, ReportFormat(path, format), path, w.abort)
+   })
+}
+
+/* beginExport
+**		Runs an export in the background, as for a scan: the HTML report and
+** patches fetch the remote copy of each changed file.
+*/
+
+func (w *MainWindow) beginExport (name string, export func () error) {
+	w.scanState = Scanner__Exporting
+	w.exportName = name
+	w.ShowStatus("Exporting " + name + " ...")
+	go func () {
+		w.exported <- export()
+		w.ExportDone()
+	}()
+}
+
+/* exportDone
+**		Signal received when the goroutine writing a report (or patch)
+** finishes. As for a scan, the result is sent on a channel.
+*/
+
+func (w *MainWindow) exportDone () {
+	err := <- w.exported
+	w.scanState = Scanner__Idle
+	if err != nil {
+		w.TempStatus("Export failed")
+		w.showError("Export " + w.exportName, err)
+	} else {
+		w.TempStatus(strings.Title(w.exportName) + " saved")
+	}
 }
 
 /* scanComplete
@@ -228,7 +476,9 @@ func (w *MainWindow) beginScan (bool) {
 func (w *MainWindow) scanComplete () {
 	if w.scanState != Scanner__Idle {
 		err := <- w.errors
-		if err != nil {
+		if Opt.Output != "" {
+			w.batchComplete(err)
+		} else if err != nil {
 			w.TempStatus("Scan failed")
 			w.showError("Scan", err)
 		} else {
@@ -240,19 +490,44 @@ func (w *MainWindow) scanComplete () {
 	w.scanState = Scanner__Idle
 }
 
+/* batchComplete
+**		Called instead of the normal completion when a report file was named on
+** the command line. Saves the report and quits, with a non-zero exit status if
+** the scan or report failed.
+*/
+
+func (w *MainWindow) batchComplete (err error) {
+	if err == nil {
+		w.cache.Write()
+		err = SaveReport(w.cache, ReportFormat(Opt.Output, Opt.ReportFormat), Opt.Output, nil)
+	}
+	
+	status := 0
+	if err != nil { log.Println("Scan:", err); status = 1 }
+	core.QCoreApplication_Exit(status)
+}
+
 /* EndScan
-**		Called to abort the current scan on program exit. Because the Qt event
-**	loop has already finished at this point, we call 'scanComplete' manually,
-** to wait for the signal from the scanner GoRoutine that it has finished.
+**		Called to abort the current scan (or export) on program exit. Because
+** the Qt event loop has already finished at this point, we wait here for the
+** result from the GoRoutine, rather than for its signal. A cancelled export
+** leaves any existing file as it was.
 */
 
 func (w *MainWindow) EndScan () {
-	if w.scanState == Scanner__Active {
-		w.scanState = Scanner__Stopping
-		w.abort <- true
-		err := <- w.errors
-		if err != nil { log.Println("Scan:", err) } else {
-			w.cache.Write()
+	switch w.scanState {
+		case Scanner__Active: {
+			w.scanState = Scanner__Stopping
+			w.abort <- true
+			err := <- w.errors
+			if err != nil { log.Println("Scan:", err) } else {
+				w.cache.Write()
+			}
+		}
+		case Scanner__Exporting: {
+			w.scanState = Scanner__Stopping
+			w.abort <- true
+			if err := <- w.exported; err != nil && err != E_Cancelled { log.Println("Export:", err) }
 		}
 	}
 }
@@ -279,6 +554,103 @@ func (w *MainWindow) resetScan (bool) {
    }
 }
 
+/* beginView
+**    Starts fetching a file to view, in the background. The connection left
+** open by the last file viewed is used again, if possible. Only one file is
+** fetched at a time.
+*/
+
+func (w *MainWindow) beginView (path string) error {
+	if w.viewing { return nil }
+	
+	var size int64
+	if fp, ok := w.cache.FilePrints[path]; ok { size = fp.Remote.Size }
+	
+	w.viewing = true
+	w.cancel.Show()
+	conn, src := w.viewConn, w.sourceConn
+	w.viewConn, w.sourceConn = nil, nil
+	go FetchView(path, size, conn, src, w.views, w.viewStop)
+	return nil
+}
+
+/* viewReady
+**		Signal received when the goroutine fetching a file to view finishes.
+** As for a scan, the result is sent on a channel.
+*/
+
+func (w *MainWindow) viewReady () {
+	r := <- w.views
+	w.viewing = false
+	w.cancel.Hide()
+	select { case <- w.viewStop: default: }
+	
+	// Keep the connections, unless the site was changed meanwhile (or
+	// others were opened)
+	if r.Conn != nil {
+		if r.Site == Config && w.viewConn == nil { w.viewConn = r.Conn } else { r.Conn.Close() }
+	}
+	if r.Source != nil {
+		if r.Site == Config && w.sourceConn == nil { w.sourceConn = r.Source } else { r.Source.Close() }
+	}
+	
+	switch {
+		case r.Err == E_Cancelled:
+			w.TempStatus("Cancelled")
+		case r.Err != nil:
+			w.TempStatus("View failed")
+			w.showError("View", r.Err)
+		default:
+			w.TempStatus("")
+			if viewer == nil { viewer = NewFileViewer(nil, 0) }
+			viewer.SetResult(r)
+			viewer.Open()
+	}
+}
+
+/* viewConnection
+**		Returns the open connection kept for viewing files, opening one if
+** there is none.
+*/
+
+func (w *MainWindow) viewConnection () (FTPConn, error) {
+	if w.viewConn == nil {
+		conn, err := DialRemote()
+		if err != nil { return nil, err }
+		w.viewConn = conn
+	}
+	return w.viewConn, nil
+}
+
+/* sourceConnection
+**		Returns the open connection kept for a remote source, opening one if
+** there is none. Returns nil if the source is a local folder.
+*/
+
+func (w *MainWindow) sourceConnection () (FTPConn, error) {
+	if w.sourceConn == nil {
+		conn, err := openSource()
+		if err != nil { return nil, err }
+		w.sourceConn = conn
+	}
+	return w.sourceConn, nil
+}
+
+/* closeView
+**		Closes the connections kept for viewing files (if any).
+*/
+
+func (w *MainWindow) closeView () {
+	if w.viewConn != nil {
+		w.viewConn.Close()
+		w.viewConn = nil
+	}
+	if w.sourceConn != nil {
+		w.sourceConn.Close()
+		w.sourceConn = nil
+	}
+}
+
 /* viewSelected
 **    Shows the differences between local & remote copies of the currently
 ** selected file.
@@ -303,6 +675,20 @@ func (w *MainWindow) showError (scope string, err error) {
    )
 }
 
+/* startError
+**    Displays an error that stops a scan (or manifest check) from starting.
+** For one asked for on the command line, there may be nobody to dismiss a
+** dialog, so the error is logged and the program quits at once with a non-zero
+** status. This happens before the event loop runs, so 'QCoreApplication_Exit'
+** would have no effect.
+*/
+
+func (w *MainWindow) startError (scope string, err error) {
+   if ! w.batch { w.showError(scope, err); return }
+   log.Printf("%s: %v\n", scope, err)
+   os.Exit(1)
+}
+
 /* showStatus
 **    Displays a message in the main window status bar. The message is
 ** temporary, so the next message will displace it, but will not disappear
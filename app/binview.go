@@ -0,0 +1,256 @@
+package app
+
+/*
+** This file contains the logic to compare files that are not plain text, for
+** the file viewer: a hex dump of binary files with the differing bytes marked,
+** images shown together with a pixel difference overlay, and a listing of the
+** contents of zip (or jar) archives.
+*/
+
+import (
+   "fmt"
+   "html"
+   "bytes"
+   "sort"
+   "strings"
+   "path/filepath"
+   "image"
+   "image/color"
+   "image/png"
+   _ "image/jpeg"
+   _ "image/gif"
+   "archive/zip"
+)
+
+// Kinds of file content, each shown in a different way by the file viewer
+const (
+   Content__Text = iota
+   Content__Binary
+   Content__Image
+   Content__Archive
+   Content__Summary
+)
+
+// Number of bytes in each row of a hex dump
+const HexWidth = 16
+
+// Largest image (in pixels) to be shown and compared
+const ImagePixelLimit = 25000000
+
+/*---------------------------------------------------------------------------
+   ContentKind
+      Decides how to show a file in the viewer, from its name and content.
+   Images and archives are recognised by extension; any other file is taken
+   to be binary if either copy contains a zero byte near the start, unless
+   that copy starts with a UTF-16 byte order mark.
+---------------------------------------------------------------------------*/
+
+func ContentKind (path string, local, remote []byte) int {
+   switch strings.ToLower(filepath.Ext(path)) {
+      case ".png", ".jpg", ".jpeg", ".gif": return Content__Image
+      case ".zip", ".jar": return Content__Archive
+   }
+   for _, data := range [][]byte{local, remote} {
+      if DetectEncoding(data) == "UTF-16" { continue }
+      if len(data) > 8000 { data = data[:8000] }
+      if bytes.IndexByte(data, 0) >= 0 { return Content__Binary }
+   }
+   return Content__Text
+}
+
+/*---------------------------------------------------------------------------
+   HexRows
+      Compares two binary files at the same offsets and returns one row for
+   each 'HexWidth' bytes, in the same form as a side-by-side comparison of
+   text. The 'line numbers' count rows, so the offset of a row is given by
+   (number - 1) * HexWidth.
+---------------------------------------------------------------------------*/
+
+func HexRows (local, remote []byte) []DiffRow {
+   size := len(local)
+   if len(remote) > size { size = len(remote) }
+
+   rows := make([]DiffRow, 0, size / HexWidth + 1)
+   for n := 0; n < size; n += HexWidth {
+      row := DiffRow{ Type: Row__Changed }
+      if n < len(local) {
+         row.Left = string(local[n:minInt(n + HexWidth, len(local))])
+         row.LeftNo = n / HexWidth + 1
+      } else { row.Type = Row__Inserted }
+      if n < len(remote) {
+         row.Right = string(remote[n:minInt(n + HexWidth, len(remote))])
+         row.RightNo = n / HexWidth + 1
+      } else { row.Type = Row__Deleted }
+      if row.Left == row.Right { row.Type = Row__Equal }
+      rows = append(rows, row)
+   }
+   return rows
+}
+
+func minInt (a, b int) int {
+   if a < b { return a }
+   return b
+}
+
+/*---------------------------------------------------------------------------
+   HexHtml
+      Returns the rich text (HTML) for one side of a hex comparison, with an
+   offset, the bytes in hex and the printable characters on each row. Bytes
+   that differ from the other side are highlighted. As for 'SideHtml', also
+   returns the number of blocks of changes, each marked with an anchor.
+---------------------------------------------------------------------------*/
+
+func HexHtml (rows []DiffRow, left bool) (string, int) {
+   var buf strings.Builder
+   buf.WriteString("<table cellspacing=\"0\" cellpadding=\"1\">")
+
+   blocks := 0
+   for n, row := range rows {
+      data, other, num, colour := row.Right, row.Left, row.RightNo, "#e0f2f4"
+      if left { data, other, num, colour = row.Left, row.Right, row.LeftNo, "#fbe3e3" }
+
+      anchor := ""
+      if row.Type != Row__Equal && row.Type != Row__Skipped &&
+         (n == 0 || rows[n-1].Type == Row__Equal || rows[n-1].Type == Row__Skipped) {
+         anchor = fmt.Sprintf("<a name=\"c%d\"></a>", blocks)
+         blocks++
+      }
+
+      if row.Type == Row__Skipped {
+         fmt.Fprintf(
+            &buf,
+            "<tr bgcolor=\"#eeeeee\"><td>%s</td><td colspan=\"2\"><i>... %d identical rows ...</i></td></tr>",
+            anchor, row.LeftNo,
+         )
+         continue
+      }
+      if num == 0 {
+         fmt.Fprintf(&buf, "<tr bgcolor=\"#f4f4f4\"><td>%s&nbsp;</td><td></td><td></td></tr>", anchor)
+         continue
+      }
+
+      var hx, chars strings.Builder
+      for k := 0; k < HexWidth; k++ {
+         if k == HexWidth / 2 { hx.WriteString(" ") }
+         if k >= len(data) { hx.WriteString("   "); continue }
+
+         c := data[k]
+         ch := "."
+         if c >= 0x20 && c < 0x7f { ch = html.EscapeString(string(rune(c))) }
+         if k >= len(other) || other[k] != c {
+            fmt.Fprintf(&hx, "<span style=\"background-color:%s;\">%02x</span> ", colour, c)
+            fmt.Fprintf(&chars, "<span style=\"background-color:%s;\">%s</span>", colour, ch)
+         } else {
+            fmt.Fprintf(&hx, "%02x ", c)
+            chars.WriteString(ch)
+         }
+      }
+
+      fmt.Fprintf(
+         &buf,
+         "<tr><td style=\"color:#888888;\">%s<pre style=\"margin:0;\">%08x</pre></td>" +
+         "<td><pre style=\"margin:0;\">%s</pre></td><td><pre style=\"margin:0;\">%s</pre></td></tr>",
+         anchor, (num - 1) * HexWidth, hx.String(), chars.String(),
+      )
+   }
+
+   buf.WriteString("</table>")
+   return buf.String(), blocks
+}
+
+/*---------------------------------------------------------------------------
+   ImageDiff
+      Decodes two images (PNG, JPEG or GIF) and returns an overlay, encoded
+   as PNG, that shows the local image faded to grey with the differing pixels
+   in red. If the sizes differ, the overlay covers both and any pixel that is
+   only in one image counts as different. Also returns the number of pixels
+   that differ.
+---------------------------------------------------------------------------*/
+
+func ImageDiff (local, remote []byte) ([]byte, int, error) {
+   if err := CheckImageSize(local, remote); err != nil { return nil, 0, err }
+   img1, _, err := image.Decode(bytes.NewReader(local))
+   if err != nil { return nil, 0, fmt.Errorf("Local image: %v", err) }
+   img2, _, err := image.Decode(bytes.NewReader(remote))
+   if err != nil { return nil, 0, fmt.Errorf("Remote image: %v", err) }
+
+   b1, b2 := img1.Bounds(), img2.Bounds()
+   w, h := b1.Dx(), b1.Dy()
+   if b2.Dx() > w { w = b2.Dx() }
+   if b2.Dy() > h { h = b2.Dy() }
+
+   out := image.NewRGBA(image.Rect(0, 0, w, h))
+   red := color.RGBA{ 0xe0, 0x10, 0x10, 0xff }
+   count := 0
+   for y := 0; y < h; y++ {
+      for x := 0; x < w; x++ {
+         p1 := image.Pt(b1.Min.X + x, b1.Min.Y + y)
+         p2 := image.Pt(b2.Min.X + x, b2.Min.Y + y)
+         in1, in2 := p1.In(b1), p2.In(b2)
+
+         if in1 && in2 && sameColour(img1.At(p1.X, p1.Y), img2.At(p2.X, p2.Y)) {
+            g := color.GrayModel.Convert(img1.At(p1.X, p1.Y)).(color.Gray)
+            v := 0xc0 + g.Y / 4
+            out.Set(x, y, color.RGBA{ v, v, v, 0xff })
+            continue
+         }
+         out.Set(x, y, red)
+         count++
+      }
+   }
+
+   var buf bytes.Buffer
+   err = png.Encode(&buf, out)
+   return buf.Bytes(), count, err
+}
+
+/*---------------------------------------------------------------------------
+   CheckImageSize
+      Checks the sizes of two images, as given in their headers, before they
+   are decoded: an image of more than 'ImagePixelLimit' pixels would take too
+   much memory (and time) to show or compare. An image that can't be decoded
+   is not an error here.
+---------------------------------------------------------------------------*/
+
+func CheckImageSize (local, remote []byte) error {
+   for _, data := range [][]byte{local, remote} {
+      c, _, err := image.DecodeConfig(bytes.NewReader(data))
+      if err == nil && int64(c.Width) * int64(c.Height) > ImagePixelLimit {
+         return fmt.Errorf("Image too large to compare (%d x %d pixels)", c.Width, c.Height)
+      }
+   }
+   return nil
+}
+
+/* sameColour
+**    Compares two colours, ignoring the colour model.
+*/
+
+func sameColour (c1, c2 color.Color) bool {
+   r1, g1, b1, a1 := c1.RGBA()
+   r2, g2, b2, a2 := c2.RGBA()
+   return r1 == r2 && g1 == g2 && b1 == b2 && a1 == a2
+}
+
+/*---------------------------------------------------------------------------
+   ArchiveListing
+      Returns a listing of the contents of a zip (or jar) archive, as text,
+   with one line per entry giving the name, size and checksum. Timestamps are
+   left out, as they change whenever an archive is rebuilt. The entries are
+   sorted by name, so that two listings can be compared line by line.
+---------------------------------------------------------------------------*/
+
+func ArchiveListing (data []byte) (string, error) {
+   zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+   if err != nil { return "", err }
+
+   files := make([]*zip.File, len(zr.File))
+   copy(files, zr.File)
+   sort.Slice(files, func (i, j int) bool { return files[i].Name < files[j].Name })
+
+   var buf strings.Builder
+   for _, f := range files {
+      fmt.Fprintf(&buf, "%s  %d bytes  crc32 %08x\n", f.Name, f.UncompressedSize64, f.CRC32)
+   }
+   return buf.String(), nil
+}
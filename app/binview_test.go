@@ -0,0 +1,48 @@
+package app
+
+import (
+   "bytes"
+   "testing"
+   "image"
+   "image/color"
+   "image/png"
+   "hash/crc32"
+   "encoding/binary"
+)
+
+/* pngData
+**    Returns a PNG image of the given size, filled with one colour.
+*/
+
+func pngData (t *testing.T, w, h int, c color.Color) []byte {
+   img := image.NewRGBA(image.Rect(0, 0, w, h))
+   for y := 0; y < h; y++ { for x := 0; x < w; x++ { img.Set(x, y, c) } }
+   var buf bytes.Buffer
+   if err := png.Encode(&buf, img); err != nil { t.Fatal(err) }
+   return buf.Bytes()
+}
+
+func TestImageDiff (t *testing.T) {
+   white := color.RGBA{ 0xff, 0xff, 0xff, 0xff }
+   local := pngData(t, 4, 4, white)
+   remote := pngData(t, 4, 5, white)
+
+   overlay, count, err := ImageDiff(local, remote)
+   if err != nil { t.Fatal(err) }
+   if count != 4 { t.Errorf("got %d pixels differing, want 4", count) }
+   c, err := png.DecodeConfig(bytes.NewReader(overlay))
+   if err != nil || c.Width != 4 || c.Height != 5 { t.Errorf("overlay: got %d x %d, %v", c.Width, c.Height, err) }
+}
+
+func TestCheckImageSize (t *testing.T) {
+   // A small file may claim a huge size in its header
+   data := pngData(t, 1, 1, color.Black)
+   ihdr := data[8:33] // length, type, width, height, ..., CRC
+   binary.BigEndian.PutUint32(ihdr[8:], 30000)
+   binary.BigEndian.PutUint32(ihdr[12:], 30000)
+   binary.BigEndian.PutUint32(ihdr[21:], crc32.ChecksumIEEE(ihdr[4:21]))
+
+   if err := CheckImageSize(data, pngData(t, 1, 1, color.Black)); err == nil { t.Errorf("no error for huge image") }
+   if _, _, err := ImageDiff(pngData(t, 1, 1, color.Black), data); err == nil { t.Errorf("ImageDiff: no error for huge image") }
+   if err := CheckImageSize(pngData(t, 1, 1, color.Black), []byte("not an image")); err != nil { t.Errorf("got %v", err) }
+}
@@ -22,6 +22,7 @@ import (
 type FilePrint struct {
    Local,
    Remote      FileInfo
+   Base        []byte         // hash of the base copy for merging (if kept)
 }
 
 type FileInfo struct {
@@ -30,6 +31,8 @@ type FileInfo struct {
    ModTime     time.Time
    Size        int64
    Hash        []byte
+   Tag         []byte         // MD5 of the content, if given by the server
+   Stale       bool           // hash to be recomputed on the next scan
 }
 
 /*---------------------------------------------------------------------------
@@ -42,6 +45,7 @@ type FileInfo struct {
 type Cache struct {
    // public fields - saved to disk:
    FilePrints  map[string]*FilePrint
+   Ignore      TextOptions    // options used for text fingerprints
    
    // private fields:
    path        string
@@ -55,7 +59,9 @@ type Cache struct {
 func NewCache () *Cache {
    path := Config.CacheFile
    if path != "" && filepath.Base(path) == path {
-      path = filepath.Join(Config.Source, path)
+      if Config.RemoteSource() != nil {
+         path = sourceCachePath(path)
+      } else { path = filepath.Join(Config.Source, path) }
    }
    return &Cache{
       FilePrints: make(map[string]*FilePrint),
@@ -63,6 +69,19 @@ func NewCache () *Cache {
    }
 }
 
+/*---------------------------------------------------------------------------
+   NewTransientCache
+      Creates an 'empty' cache that is never written to disk. This is used to
+   hold results that should not replace the saved fingerprints for the site,
+   such as a check against a manifest.
+---------------------------------------------------------------------------*/
+
+func NewTransientCache () *Cache {
+   return &Cache{
+      FilePrints: make(map[string]*FilePrint),
+   }
+}
+
 /*---------------------------------------------------------------------------
    LoadCache
       Reads and decodes the saved cache file from the last run. If that file
@@ -96,6 +115,7 @@ func LoadCache () (*Cache, error) {
 ---------------------------------------------------------------------------*/
 
 func (cache *Cache) Write () {
+   if cache.Transient() { return }
    err := Config.Check()
    if err != nil { return }
    
@@ -114,6 +134,29 @@ func (cache *Cache) Write () {
    }
 }
 
+/*---------------------------------------------------------------------------
+   Cache::Transient
+      Returns 'true' if the cache is not backed by a file on disk.
+---------------------------------------------------------------------------*/
+
+func (cache *Cache) Transient () bool {
+   return cache.path == ""
+}
+
+/*---------------------------------------------------------------------------
+   Cache::Rehash
+      Forces the fingerprint of every file to be recomputed on the next scan,
+   by marking it as stale. The mark is saved with the cache, so that it still
+   applies if the scan is stopped.
+---------------------------------------------------------------------------*/
+
+func (cache *Cache) Rehash () {
+   for _, ent := range cache.FilePrints {
+      ent.Local.Stale = ! ent.Local.IsDir
+      ent.Remote.Stale = ! ent.Remote.IsDir
+   }
+}
+
 /*---------------------------------------------------------------------------
    Cache::AddEntry
       Adds or retrieves a fingerprint entry for a file or folder.
@@ -0,0 +1,183 @@
+package app
+
+/*
+** This file contains the checks made on the certificate of a TLS server (for
+** FTPS and WebDAV over HTTPS). A certificate that cannot be verified from the
+** system roots, e.g. one that is self-signed, is trusted only if the user
+** accepts it. The public key of an accepted certificate is then "pinned" for
+** the site, so a renewed certificate with the same key is still trusted.
+*/
+
+import (
+   "fmt"
+   "time"
+   "bytes"
+   "strings"
+   "crypto/x509"
+   "crypto/sha256"
+   "encoding/base64"
+   "github.com/therecipe/qt/widgets"
+)
+
+// A pinned certificate this close to expiry gives a warning
+const PinExpiryWarning = 30 * 24 * time.Hour
+
+/*---------------------------------------------------------------------------
+   CertPin [type]
+      A trusted server public key: the SHA-256 hash of the 'subject public
+   key info' of a certificate, with details of that certificate for display.
+---------------------------------------------------------------------------*/
+
+type CertPin struct {
+   Hash        []byte
+   Subject,
+   Issuer      string
+   Expiry      time.Time
+}
+
+/* NewCertPin
+**    Returns the pin for a certificate.
+*/
+
+func NewCertPin (cert *x509.Certificate) CertPin {
+   sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+   return CertPin{
+      Hash:    sum[:],
+      Subject: cert.Subject.String(),
+      Issuer:  cert.Issuer.String(),
+      Expiry:  cert.NotAfter,
+   }
+}
+
+/* Fingerprint
+**    Returns the hash in the usual form for a key pin.
+*/
+
+func (p *CertPin) Fingerprint () string {
+   return "sha256/" + base64.StdEncoding.EncodeToString(p.Hash)
+}
+
+/* describe
+**    Returns the details of the pinned certificate, for display.
+*/
+
+func (p *CertPin) describe () string {
+   return fmt.Sprintf(
+      "  Key:     %s\n  Subject: %s\n  Issuer:  %s\n  Expires: %s\n",
+      p.Fingerprint(), p.Subject, p.Issuer, p.Expiry.Local().Format("2 Jan 2006"),
+   )
+}
+
+/*---------------------------------------------------------------------------
+   RemoteSide::FindPin
+      Returns the pin for the server that matches the given one, or nil if
+   none does.
+---------------------------------------------------------------------------*/
+
+func (r *RemoteSide) FindPin (pin CertPin) *CertPin {
+   pins := *r.pins
+   for n := range pins {
+      if bytes.Equal(pins[n].Hash, pin.Hash) { return &pins[n] }
+   }
+   return nil
+}
+
+/*---------------------------------------------------------------------------
+   RemoteSide::vetServerTrust
+      Called to vet the TLS server certificate, in place of normal checking
+   of trust chains. Attempts to verify the chain of trust from the server's
+   given certificates. If the cert is verified then of course we allow it.
+   If not, the server's public key must have been pinned for this site;
+   otherwise we ask the user if they want to trust it. This is normally the
+   case if the cert is 'self-signed'. Each side of a site has its own pins.
+---------------------------------------------------------------------------*/
+
+func (r *RemoteSide) vetServerTrust (raw [][]byte, verified [][]*x509.Certificate) error {
+   certs := make([]*x509.Certificate, 0, len(raw))
+   for _, r := range raw {
+      c, err := x509.ParseCertificate(r)
+      if err != nil { return err }
+      certs = append(certs, c)
+   }
+   if len(certs) == 0 { return fmt.Errorf("No TLS certificate from server") }
+   
+   leaf := certs[0]
+   pin := NewCertPin(leaf)
+   if *r.hostKey != nil && bytes.Equal(*r.hostKey, leaf.Signature) {
+      // Trusted by an earlier version, which kept the signature instead
+      *r.hostKey = nil
+      *r.pins = append(*r.pins, pin)
+   }
+   if old := r.FindPin(pin); old != nil {
+      *old = pin // the certificate may have been renewed
+      r.warnPinExpiry(leaf)
+      return nil // already decided to trust
+   }
+   
+   pool := x509.NewCertPool()
+   for _, c := range certs[1:] { pool.AddCert(c) }
+   
+   _, err := leaf.Verify(x509.VerifyOptions{
+      DNSName:       r.Addr.Hostname(),
+      Roots:         nil, // use system roots
+      Intermediates: pool,
+   })
+   if err == nil { return nil }
+   
+   box := widgets.NewQMessageBox2(
+      widgets.QMessageBox__Warning,
+      "TLS Certificate",
+      fmt.Sprintf(
+         "The security certificate from %s could not be verified.\n%s\n",
+         r.Addr.Host,
+         err.Error(),
+      ),
+      widgets.QMessageBox__Ok | widgets.QMessageBox__Cancel,
+      nil, 0,
+   )
+   
+   var details strings.Builder
+   details.WriteString("New certificate:\n")
+   details.WriteString(pin.describe())
+   if len(*r.pins) > 0 {
+      details.WriteString("\nThe public key differs from that of the certificate(s) trusted before:\n")
+      for _, old := range *r.pins { details.WriteString(old.describe()) }
+      box.SetInformativeText("The server's key has changed. Do you trust this server?")
+   } else {
+      box.SetInformativeText("Do you trust this server?")
+   }
+   box.SetDetailedText(details.String())
+   
+   answer := box.Exec()
+   if answer == int(widgets.QMessageBox__Ok) {
+      *r.pins = append(*r.pins, pin)
+      r.warnPinExpiry(leaf)
+      return nil
+   }
+   
+   return fmt.Errorf("TLS certificate not trusted")
+}
+
+/* warnPinExpiry
+**    Warns (once per session) if a pinned certificate is about to expire, as
+** a new certificate may come with a new key, which will need to be trusted.
+*/
+
+func (r *RemoteSide) warnPinExpiry (leaf *x509.Certificate) {
+   left := time.Until(leaf.NotAfter)
+   if left > PinExpiryWarning || *r.expiryWarned { return }
+   *r.expiryWarned = true
+   
+   msg := fmt.Sprintf("The trusted certificate for %s has expired.", r.Addr.Host)
+   if left > 0 {
+      msg = fmt.Sprintf(
+         "The trusted certificate for %s expires in %d days (%s).",
+         r.Addr.Host, int(left.Hours() / 24), leaf.NotAfter.Local().Format("2 Jan 2006"),
+      )
+   }
+   widgets.QMessageBox_Warning(
+      nil, "TLS Certificate",
+      msg + "\nIf its replacement has a new key, you will be asked to trust it again.",
+      widgets.QMessageBox__Ok, widgets.QMessageBox__NoButton,
+   )
+}
@@ -8,6 +8,8 @@ package app
 import (
    "os"
    "log"
+   "net"
+   "strconv"
    "strings"
    "errors"
    "fmt"
@@ -70,10 +72,34 @@ type SiteConfig struct {
    Exclude,
    BinaryFiles string
    RemoteAddr  *url.URL
-   ServerKey   []byte
+   ServerKey   []byte         // SSH host key
+   SourceKey   []byte         // SSH host key of a remote source
+   CertPins    []CertPin      // trusted TLS server keys
+   SourcePins  []CertPin      // trusted TLS keys of a remote source
+   ManifestKeys [][]byte
+   ShownColumns []string
+   TreeView    bool
+   Ignore      TextOptions
+   ViewLimit   int            // MB; zero for the default
+   Endpoint,                  // S3 only: blank for AWS
+   Region,
+   AccessKey,                 // S3 only: blank to use the username
+   Secret      string         // S3 only: blank to use the password
+   IgnoreETags bool           // S3 only: ETags are not MD5 hashes
+   TLS         TLSPolicy
+   FTP         FTPOptions
+   Proxy,                     // URL of proxy, if any
+   JumpHost    string         // SFTP only: [user@]host[:port]
+   JumpKey     []byte         // SSH host key of the jump host
+   TimeTolerance int          // seconds allowed between remote file times
+   Bandwidth   int            // KB/s; zero for no limit
    
    // session-only (not saved)
-   password    string
+   password,
+   sourcePassword,
+   jumpPassword string
+   expiryWarned,
+   sourceWarned bool
 }
 
 /* New
@@ -101,15 +127,55 @@ func (c *SiteConfig) Check () error {
    if c.Source == "" {
       return errors.New("No source configured for scan") 
    }
-   if c.RemoteAddr.Host == "" {
-      return errors.New("No remote server configured for scan")
-   }
+   if err := c.CheckSource(); err != nil { return err }
+   if err := c.CheckRemote(); err != nil { return err }
    if c.CacheFile == "" {
       return errors.New("Cache file name must not be blank")
    }
    return nil
 }
 
+/* CheckRemote
+**    Checks only the remote part of the site config. This is sufficient for
+** operations that do not need the local copy.
+*/
+
+func (c *SiteConfig) CheckRemote () error {
+   if c.RemoteAddr.Scheme == "file" {
+      if c.RemoteAddr.Path == "" {
+         return errors.New("No remote folder configured for scan")
+      }
+   } else if c.RemoteAddr.Host == "" {
+      return errors.New("No remote server configured for scan")
+   }
+   return nil
+}
+
+/* ColumnShown
+**    Returns 'true' if the named optional report column should be shown for
+** this site.
+*/
+
+func (c *SiteConfig) ColumnShown (name string) bool {
+   for _, v := range c.ShownColumns {
+      if v == name { return true }
+   }
+   return false
+}
+
+/* ShowColumn
+**    Records whether an optional report column is to be shown for this site.
+*/
+
+func (c *SiteConfig) ShowColumn (name string, yes bool) {
+   cols := make([]string, 0, len(c.ShownColumns) + 1)
+   for _, v := range c.ShownColumns {
+      if v != name { cols = append(cols, v) }
+   }
+   if yes { cols = append(cols, name) }
+   c.ShownColumns = cols
+}
+
 /* Save
 **    Called as the program is about to exit and after making edits. Saves
 ** modified site data to disk.
@@ -274,9 +340,30 @@ type SiteDetailPane struct {
    password,
    cacheFile,
    exclude,
-   binary      *widgets.QLineEdit
-   source      *FileSelector
-   scheme      *widgets.QComboBox
+   binary,
+   endpoint,
+   region,
+   accessKey,
+   secret,
+   activeAddr,
+   proxy,
+   jumpHost    *widgets.QLineEdit
+   ignore      []*widgets.QCheckBox
+   viewLimit,
+   port,
+   timeOffset,
+   tolerance,
+   bandwidth   *widgets.QSpinBox
+   source,
+   clientCert,
+   clientKey   *FileSelector
+   scheme,
+   tlsVersion,
+   ftpMode     *widgets.QComboBox
+   encryptData,
+   etags,
+   ipv6,
+   detectOffset *widgets.QCheckBox
 	advanced		*widgets.QPushButton
 	frame			*widgets.QGroupBox
    
@@ -295,9 +382,13 @@ func (p *SiteDetailPane) init () {
    
    p.name = widgets.NewQLineEdit(nil); p.AddRow3("Name", p.name)
    p.source = NewFileSelector(nil, 0); p.AddRow3("Source", p.source)
+   p.source.SetPlaceholderText("Local folder, or URL of another remote copy")
    p.server = widgets.NewQLineEdit(nil); p.AddRow3("Server", p.server)
+   p.port = widgets.NewQSpinBox(nil); p.AddRow3("Port", p.port)
+   p.port.SetRange(0, 65535)
+   p.port.SetSpecialValueText("Default")
    p.scheme = widgets.NewQComboBox(nil); p.AddRow3("Scheme", p.scheme)
-   p.scheme.AddItems([]string{"FTP (insecure)", "FTPS with explicit TLS", "SFTP"})
+   p.scheme.AddItems(SchemeNames)
    p.remotePath = widgets.NewQLineEdit(nil); p.AddRow3("Root folder", p.remotePath)
    p.username = widgets.NewQLineEdit(nil); p.AddRow3("Username", p.username)
    p.password = widgets.NewQLineEdit(nil); p.AddRow3("Password", p.password)
@@ -314,15 +405,86 @@ func (p *SiteDetailPane) init () {
    p.exclude = widgets.NewQLineEdit(nil); opt.AddRow3("Exclude", p.exclude)
    p.binary = widgets.NewQLineEdit(nil); opt.AddRow3("Binary", p.binary)
    
+   box := widgets.NewQWidget(nil, 0)
+   hbox := widgets.NewQHBoxLayout2(box)
+   hbox.SetContentsMargins(0, 0, 0, 0)
+   for _, label := range []string{"Trailing space", "All space", "Blank lines", "Case", "Encoding"} {
+      cb := widgets.NewQCheckBox2(label, nil)
+      hbox.AddWidget(cb, 0, 0)
+      p.ignore = append(p.ignore, cb)
+   }
+   hbox.AddStretch(1)
+   opt.AddRow3("Ignore", box)
+   
+   p.viewLimit = widgets.NewQSpinBox(nil); opt.AddRow3("View limit", p.viewLimit)
+   p.viewLimit.SetRange(1, 1024)
+   p.viewLimit.SetSuffix(" MB")
+   p.viewLimit.SetValue(DefaultViewLimit)
+   
+   p.endpoint = widgets.NewQLineEdit(nil); opt.AddRow3("S3 endpoint", p.endpoint)
+   p.endpoint.SetPlaceholderText("AWS")
+   p.region = widgets.NewQLineEdit(nil); opt.AddRow3("S3 region", p.region)
+   p.region.SetPlaceholderText(DefaultRegion)
+   p.accessKey = widgets.NewQLineEdit(nil); opt.AddRow3("S3 access key", p.accessKey)
+   p.accessKey.SetPlaceholderText("Username")
+   p.secret = widgets.NewQLineEdit(nil); opt.AddRow3("S3 secret key", p.secret)
+   p.secret.SetPlaceholderText("Password")
+   p.secret.SetEchoMode(widgets.QLineEdit__Password)
+   p.etags = widgets.NewQCheckBox2("ETags are MD5 hashes (S3; not with SSE-KMS)", nil)
+   opt.AddRow3("", p.etags)
+   p.etags.SetChecked(true)
+   
+   p.tlsVersion = widgets.NewQComboBox(nil); opt.AddRow3("TLS minimum", p.tlsVersion)
+   p.tlsVersion.AddItems(TLSVersionNames)
+   p.clientCert = NewFileSelector(nil, 0); opt.AddRow3("Client cert", p.clientCert)
+   p.clientCert.Filter = "Certificates (*.pem *.crt *.cer);;All files (*)"
+   p.clientKey = NewFileSelector(nil, 0); opt.AddRow3("Client key", p.clientKey)
+   p.clientKey.Filter = "Keys (*.pem *.key);;All files (*)"
+   p.encryptData = widgets.NewQCheckBox2("Encrypt data connections (FTPS)", nil)
+   opt.AddRow3("", p.encryptData)
+   p.encryptData.SetChecked(true)
+   
+   p.ftpMode = widgets.NewQComboBox(nil); opt.AddRow3("FTP mode", p.ftpMode)
+   p.ftpMode.AddItems(FTPModeNames)
+   p.activeAddr = widgets.NewQLineEdit(nil); opt.AddRow3("Active address", p.activeAddr)
+   p.activeAddr.SetPlaceholderText("Same as control connection")
+   p.ipv6 = widgets.NewQCheckBox2("Use IPv6 addresses for the server name (FTP)", nil)
+   opt.AddRow3("", p.ipv6)
+   
+   box = widgets.NewQWidget(nil, 0)
+   hbox = widgets.NewQHBoxLayout2(box)
+   hbox.SetContentsMargins(0, 0, 0, 0)
+   p.timeOffset = widgets.NewQSpinBox(nil); hbox.AddWidget(p.timeOffset, 0, 0)
+   p.timeOffset.SetRange(-12 * 60, 14 * 60)
+   p.timeOffset.SetSingleStep(15)
+   p.timeOffset.SetSuffix(" min")
+   p.detectOffset = widgets.NewQCheckBox2("Detect when connecting", nil)
+   hbox.AddWidget(p.detectOffset, 0, 0)
+   hbox.AddStretch(1)
+   opt.AddRow3("Server time (FTP)", box)
+   p.tolerance = widgets.NewQSpinBox(nil); opt.AddRow3("Time tolerance", p.tolerance)
+   p.tolerance.SetRange(0, 3600)
+   p.tolerance.SetSuffix(" s")
+   p.bandwidth = widgets.NewQSpinBox(nil); opt.AddRow3("Bandwidth limit", p.bandwidth)
+   p.bandwidth.SetRange(0, 1000000)
+   p.bandwidth.SetSingleStep(64)
+   p.bandwidth.SetSuffix(" KB/s")
+   p.bandwidth.SetSpecialValueText("No limit")
+   
+   p.proxy = widgets.NewQLineEdit(nil); opt.AddRow3("Proxy", p.proxy)
+   p.proxy.SetPlaceholderText("None, or socks5://host:port or http://host:port")
+   p.jumpHost = widgets.NewQLineEdit(nil); opt.AddRow3("Jump host", p.jumpHost)
+   p.jumpHost.SetPlaceholderText("None, or user@host:port (SFTP)")
+   
    // Connect actions ...
    
    p.name.ConnectTextEdited(func (text string) { Config.Name = text; p.Edited() })
-   p.source.ConnectPathChanged(func (text string) { Config.Source = text })
-   p.server.ConnectTextEdited(func (text string) {
-      Config.RemoteAddr.Host = text; Config.ServerKey = nil
-   })
+   p.source.ConnectPathChanged(p.setSource)
+   p.server.ConnectTextEdited(func (string) { p.setHost() })
+   p.server.ConnectEditingFinished(p.splitPort)
+   p.port.ConnectValueChanged(func (int) { p.setHost() })
    p.scheme.ConnectCurrentIndexChanged(func (n int) {
-		if n >= 0 { Config.RemoteAddr.Scheme = []string{"ftp", "ftps", "sftp"}[n] }
+		if n >= 0 { Config.RemoteAddr.Scheme = Schemes[n] }
    })
    p.remotePath.ConnectTextEdited(func (text string) { Config.RemoteAddr.Path = text })
    p.username.ConnectTextEdited(p.setUser)
@@ -330,6 +492,30 @@ func (p *SiteDetailPane) init () {
    p.cacheFile.ConnectTextEdited(func (text string) { Config.CacheFile = text })
    p.exclude.ConnectTextEdited(func (text string) { Config.Exclude = text })
    p.binary.ConnectTextEdited(func (text string) { Config.BinaryFiles = text })
+   for _, cb := range p.ignore {
+      cb.ConnectClicked(func (bool) { Config.Ignore = p.ignoreOptions() })
+   }
+   p.viewLimit.ConnectValueChanged(func (n int) { Config.ViewLimit = n })
+   p.endpoint.ConnectTextEdited(func (text string) { Config.Endpoint = text })
+   p.region.ConnectTextEdited(func (text string) { Config.Region = text })
+   p.accessKey.ConnectTextEdited(func (text string) { Config.AccessKey = text })
+   p.secret.ConnectTextEdited(func (text string) { Config.Secret = text })
+   p.etags.ConnectClicked(func (checked bool) { Config.IgnoreETags = ! checked })
+   p.tlsVersion.ConnectActivated(func (n int) {
+      if n >= 0 { Config.TLS.MinVersion = TLSVersions[n] }
+   })
+   p.clientCert.ConnectPathChanged(func (text string) { Config.TLS.ClientCert = text })
+   p.clientKey.ConnectPathChanged(func (text string) { Config.TLS.ClientKey = text })
+   p.encryptData.ConnectClicked(func (checked bool) { Config.TLS.ClearData = ! checked })
+   p.ftpMode.ConnectActivated(func (n int) { Config.FTP.Mode = n })
+   p.activeAddr.ConnectTextEdited(func (text string) { Config.FTP.ActiveAddr = text })
+   p.ipv6.ConnectClicked(func (checked bool) { Config.FTP.IPv6 = checked })
+   p.timeOffset.ConnectValueChanged(func (n int) { Config.FTP.TimeOffset = n })
+   p.detectOffset.ConnectClicked(func (checked bool) { Config.FTP.DetectOffset = checked })
+   p.tolerance.ConnectValueChanged(func (n int) { Config.TimeTolerance = n })
+   p.bandwidth.ConnectValueChanged(func (n int) { Config.Bandwidth = n; qMain.showBandwidth() })
+   p.proxy.ConnectTextEdited(func (text string) { Config.Proxy = text })
+   p.jumpHost.ConnectTextEdited(func (text string) { Config.JumpHost = text; Config.JumpKey = nil; Config.jumpPassword = "" })
    
    p.advanced.ConnectClicked(func (bool) { p.advanced.Hide(); p.frame.Show() })
 }
@@ -341,8 +527,12 @@ func (p *SiteDetailPane) init () {
 func (p *SiteDetailPane) ShowSite () {
    p.name.SetText(Config.Name)
    p.source.SetText(Config.Source)
-   p.server.SetText(Config.RemoteAddr.Host)
-   for n, v := range []string{"ftp", "ftps", "sftp"} {
+   p.server.SetText(Config.RemoteAddr.Hostname())
+   port, _ := strconv.Atoi(Config.RemoteAddr.Port())
+   p.port.BlockSignals(true)
+   p.port.SetValue(port)
+   p.port.BlockSignals(false)
+   for n, v := range Schemes {
       if Config.RemoteAddr.Scheme == v {
          p.scheme.SetCurrentIndex(n); break
       }
@@ -354,6 +544,42 @@ func (p *SiteDetailPane) ShowSite () {
    p.cacheFile.SetText(Config.CacheFile)
    p.exclude.SetText(Config.Exclude)
    p.binary.SetText(Config.BinaryFiles)
+   for n, v := range []bool{
+      Config.Ignore.IgnoreTrailing, Config.Ignore.IgnoreSpace,
+      Config.Ignore.IgnoreBlank, Config.Ignore.IgnoreCase, Config.Ignore.IgnoreEncoding,
+   } {
+      p.ignore[n].SetChecked(v)
+   }
+   p.viewLimit.BlockSignals(true)
+   p.viewLimit.SetValue(int(ViewLimit() >> 20))
+   p.viewLimit.BlockSignals(false)
+   p.endpoint.SetText(Config.Endpoint)
+   p.region.SetText(Config.Region)
+   p.accessKey.SetText(Config.AccessKey)
+   p.secret.SetText(Config.Secret)
+   p.etags.SetChecked(! Config.IgnoreETags)
+   p.tlsVersion.SetCurrentIndex(0)
+   for n, v := range TLSVersions {
+      if Config.TLS.MinVersion == v { p.tlsVersion.SetCurrentIndex(n) }
+   }
+   p.clientCert.SetText(Config.TLS.ClientCert)
+   p.clientKey.SetText(Config.TLS.ClientKey)
+   p.encryptData.SetChecked(! Config.TLS.ClearData)
+   p.ftpMode.SetCurrentIndex(Config.FTP.Mode)
+   p.activeAddr.SetText(Config.FTP.ActiveAddr)
+   p.ipv6.SetChecked(Config.FTP.IPv6)
+   p.timeOffset.BlockSignals(true)
+   p.timeOffset.SetValue(Config.FTP.TimeOffset)
+   p.timeOffset.BlockSignals(false)
+   p.detectOffset.SetChecked(Config.FTP.DetectOffset)
+   p.tolerance.BlockSignals(true)
+   p.tolerance.SetValue(Config.TimeTolerance)
+   p.tolerance.BlockSignals(false)
+   p.bandwidth.BlockSignals(true)
+   p.bandwidth.SetValue(Config.Bandwidth)
+   p.bandwidth.BlockSignals(false)
+   p.proxy.SetText(Config.Proxy)
+   p.jumpHost.SetText(Config.JumpHost)
 	p.frame.Hide()
 	p.advanced.Show()
 }
@@ -366,6 +592,9 @@ func (p *SiteDetailPane) Reset () {
 	p.name.Clear()
 	p.source.Clear()
 	p.server.Clear()
+	p.port.BlockSignals(true)
+	p.port.SetValue(0)
+	p.port.BlockSignals(false)
 	p.scheme.Clear()
 	p.remotePath.Clear()
 	p.username.Clear()
@@ -373,10 +602,108 @@ func (p *SiteDetailPane) Reset () {
 	p.cacheFile.Clear()
 	p.exclude.Clear()
 	p.binary.Clear()
+	for _, cb := range p.ignore { cb.SetChecked(false) }
+	p.viewLimit.BlockSignals(true)
+	p.viewLimit.SetValue(DefaultViewLimit)
+	p.viewLimit.BlockSignals(false)
+	p.endpoint.Clear()
+	p.region.Clear()
+	p.accessKey.Clear()
+	p.secret.Clear()
+	p.etags.SetChecked(true)
+	p.tlsVersion.SetCurrentIndex(0)
+	p.clientCert.Clear()
+	p.clientKey.Clear()
+	p.encryptData.SetChecked(true)
+	p.ftpMode.SetCurrentIndex(0)
+	p.activeAddr.Clear()
+	p.ipv6.SetChecked(false)
+	p.timeOffset.BlockSignals(true)
+	p.timeOffset.SetValue(0)
+	p.timeOffset.BlockSignals(false)
+	p.detectOffset.SetChecked(false)
+	p.tolerance.BlockSignals(true)
+	p.tolerance.SetValue(0)
+	p.tolerance.BlockSignals(false)
+	p.bandwidth.BlockSignals(true)
+	p.bandwidth.SetValue(0)
+	p.bandwidth.BlockSignals(false)
+	p.proxy.Clear()
+	p.jumpHost.Clear()
 	p.frame.Hide()
 	p.advanced.Show()
 }
 
+/* ignoreOptions
+**    Returns the text comparison options, as currently checked.
+*/
+
+func (p *SiteDetailPane) ignoreOptions () TextOptions {
+   return TextOptions{
+      IgnoreTrailing: p.ignore[0].IsChecked(),
+      IgnoreSpace:    p.ignore[1].IsChecked(),
+      IgnoreBlank:    p.ignore[2].IsChecked(),
+      IgnoreCase:     p.ignore[3].IsChecked(),
+      IgnoreEncoding: p.ignore[4].IsChecked(),
+   }
+}
+
+/* setHost
+**    Sets the remote host (and port, if not the default) from the input
+** fields. A port typed after the server name (as 'host:port') is used in
+** place of the one in the 'Port' field. Only an IPv6 address is enclosed in
+** brackets, as needed in a URL.
+*/
+
+func (p *SiteDetailPane) setHost () {
+   text, port := strings.TrimSpace(p.server.Text()), p.port.Value()
+   if h, pt, err := net.SplitHostPort(text); err == nil {
+      if n, err := strconv.Atoi(pt); err == nil && n > 0 && n <= 65535 { text, port = h, n }
+   }
+   host := strings.Trim(text, "[]")
+   switch {
+      case port > 0:
+         host = net.JoinHostPort(host, strconv.Itoa(port))
+      case strings.Contains(host, ":") && net.ParseIP(host) != nil:
+         host = "[" + host + "]"
+   }
+   Config.RemoteAddr.Host = host
+   Config.ServerKey = nil; Config.CertPins = nil
+}
+
+/* splitPort
+**    Moves a port typed after the server name into the 'Port' field, once
+** editing is finished.
+*/
+
+func (p *SiteDetailPane) splitPort () {
+   host, pt, err := net.SplitHostPort(strings.TrimSpace(p.server.Text()))
+   if err != nil { return }
+   n, err := strconv.Atoi(pt)
+   if err != nil || n <= 0 || n > 65535 { return }
+
+   p.server.SetText(host)
+   p.port.BlockSignals(true)
+   p.port.SetValue(n)
+   p.port.BlockSignals(false)
+   p.setHost()
+}
+
+/* setSource
+**    Sets the source from the input field. For a remote source, the keys
+** trusted and the password entered are dropped if the server changes.
+*/
+
+func (p *SiteDetailPane) setSource (text string) {
+   old := Config.RemoteSource()
+   Config.Source = text
+   addr := Config.RemoteSource()
+   if old == nil || addr == nil || old.Host != addr.Host {
+      Config.SourceKey = nil; Config.SourcePins = nil
+      Config.sourcePassword = ""
+   }
+}
+
 /* setUser
 */
 
@@ -396,6 +723,7 @@ type FileSelector struct {
    widgets.QWidget
    
    input       *widgets.QLineEdit
+   Filter      string         // to choose a file (not a folder)
    
    _ func() `constructor:"init"`
    _ func(string) `signal:"PathChanged"`
@@ -425,11 +753,16 @@ func (w *FileSelector) init () {
 
 /* browse
 **    Handles "press" event on the browse button. Opens a file selection
-** dialog to choose a local file and stores the resulting path in the input
-** field.
+** dialog to choose a local folder (or file, if a filter is set) and stores
+** the resulting path in the input field.
 */
 
 func (w *FileSelector) browse (bool) {
+   if w.Filter != "" {
+      path := widgets.QFileDialog_GetOpenFileName(nil, "Select File", w.input.Text(), w.Filter, "", 0)
+      if path != "" { w.input.SetText(path) }
+      return
+   }
    dir := widgets.QFileDialog_GetExistingDirectory(
       nil,
       "Source Folder",
@@ -447,6 +780,14 @@ func (w *FileSelector) SetText (text string) {
    w.input.SetText(text)
 }
 
+/* SetPlaceholderText
+**    Sets the text shown in the line-edit part when it is empty.
+*/
+
+func (w *FileSelector) SetPlaceholderText (text string) {
+   w.input.SetPlaceholderText(text)
+}
+
 /* Clear
 **		Resets the file path.
 */
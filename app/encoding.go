@@ -0,0 +1,111 @@
+package app
+
+/*
+** This file contains the logic to detect the character encoding of a text file
+** and convert it to UTF-8, so that files saved in different encodings can be
+** compared. Only the encodings commonly found on older web sites are handled:
+** UTF-8, UTF-16 (with a byte order mark), ISO-8859-1, ISO-8859-15 and Windows
+** code page 1252.
+*/
+
+import (
+   "bytes"
+   "strings"
+   "unicode/utf8"
+   "unicode/utf16"
+   "encoding/binary"
+)
+
+// Names of the supported encodings, as offered in the file viewer
+var Encodings = []string{"UTF-8", "UTF-16", "ISO-8859-1", "ISO-8859-15", "Windows-1252"}
+
+// Byte order marks
+var (
+   bomUTF8 = []byte{0xef, 0xbb, 0xbf}
+   bomUTF16LE = []byte{0xff, 0xfe}
+   bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+// Characters for bytes 0x80-0x9f in Windows-1252. The five unused positions
+// map to the control character with the same value, as for ISO-8859-1.
+var cp1252 = [32]rune{
+   0x20ac, 0x0081, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+   0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008d, 0x017d, 0x008f,
+   0x0090, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+   0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x009d, 0x017e, 0x0178,
+}
+
+// Characters that differ between ISO-8859-15 and ISO-8859-1
+var iso885915 = map[byte]rune{
+   0xa4: 0x20ac, 0xa6: 0x0160, 0xa8: 0x0161, 0xb4: 0x017d,
+   0xb8: 0x017e, 0xbc: 0x0152, 0xbd: 0x0153, 0xbe: 0x0178,
+}
+
+/*---------------------------------------------------------------------------
+   DetectEncoding
+      Guesses the encoding of a text file. A byte order mark is taken at
+   face value. Otherwise, the text is UTF-8 if it is valid as such, else it
+   is assumed to be Windows-1252 if it uses any of the characters that are
+   only in that code page, else ISO-8859-1.
+---------------------------------------------------------------------------*/
+
+func DetectEncoding (data []byte) string {
+   switch {
+      case bytes.HasPrefix(data, bomUTF8): return "UTF-8"
+      case bytes.HasPrefix(data, bomUTF16LE), bytes.HasPrefix(data, bomUTF16BE): return "UTF-16"
+      case utf8.Valid(data): return "UTF-8"
+   }
+   for _, c := range data {
+      if c >= 0x80 && c < 0xa0 { return "Windows-1252" }
+   }
+   return "ISO-8859-1"
+}
+
+/*---------------------------------------------------------------------------
+   DecodeText
+      Converts text in the given encoding to UTF-8, removing any byte order
+   mark. Bytes that are not valid in the encoding are replaced.
+---------------------------------------------------------------------------*/
+
+func DecodeText (data []byte, enc string) string {
+   switch enc {
+      case "UTF-16":
+         var order binary.ByteOrder = binary.LittleEndian
+         switch {
+            case bytes.HasPrefix(data, bomUTF16LE): data = data[2:]
+            case bytes.HasPrefix(data, bomUTF16BE): data, order = data[2:], binary.BigEndian
+         }
+         return decodeUTF16(data, order)
+      case "ISO-8859-1", "ISO-8859-15", "Windows-1252":
+         return decode8bit(data, enc)
+   }
+   return strings.ToValidUTF8(string(bytes.TrimPrefix(data, bomUTF8)), "�")
+}
+
+/* decodeUTF16
+**    Converts UTF-16 text (without byte order mark) to UTF-8. A trailing odd
+** byte is dropped.
+*/
+
+func decodeUTF16 (data []byte, order binary.ByteOrder) string {
+   units := make([]uint16, len(data) / 2)
+   for n := range units { units[n] = order.Uint16(data[2*n:]) }
+   return string(utf16.Decode(units))
+}
+
+/* decode8bit
+**    Converts text in one of the 8-bit encodings to UTF-8.
+*/
+
+func decode8bit (data []byte, enc string) string {
+   var buf strings.Builder
+   for _, c := range data {
+      r := rune(c)
+      switch {
+         case enc == "Windows-1252" && c >= 0x80 && c < 0xa0: r = cp1252[c - 0x80]
+         case enc == "ISO-8859-15": if v, ok := iso885915[c]; ok { r = v }
+      }
+      buf.WriteRune(r)
+   }
+   return buf.String()
+}
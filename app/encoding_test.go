@@ -0,0 +1,42 @@
+package app
+
+import (
+   "testing"
+)
+
+func TestDetectEncoding (t *testing.T) {
+   for text, want := range map[string]string{
+      "plain":            "UTF-8",
+      "caf\xc3\xa9":      "UTF-8",
+      "\xef\xbb\xbfa":    "UTF-8",
+      "\xff\xfea\x00":    "UTF-16",
+      "\xfe\xff\x00a":    "UTF-16",
+      "caf\xe9":          "ISO-8859-1",
+      "\x80 each":        "Windows-1252",
+   } {
+      if got := DetectEncoding([]byte(text)); got != want { t.Errorf("%q: got %s, want %s", text, got, want) }
+   }
+}
+
+func TestDecodeText (t *testing.T) {
+   tests := []struct {
+      data,
+      enc,
+      want        string
+   }{
+      { "caf\xc3\xa9", "UTF-8", "café" },
+      { "\xef\xbb\xbfcaf\xc3\xa9", "UTF-8", "café" },
+      { "bad\xff", "UTF-8", "bad�" },
+      { "\xff\xfeh\x00i\x00\x3d\xd8\x00\xde", "UTF-16", "hi\U0001f600" },
+      { "\xfe\xff\x00h\x00i", "UTF-16", "hi" },
+      { "h\x00i\x00", "UTF-16", "hi" },
+      { "caf\xe9 \xa4", "ISO-8859-1", "café ¤" },
+      { "caf\xe9 \xa4", "ISO-8859-15", "café €" },
+      { "\x80 \x93q\x94", "Windows-1252", "€ “q”" },
+   }
+   for _, test := range tests {
+      if got := DecodeText([]byte(test.data), test.enc); got != test.want {
+         t.Errorf("%q as %s: got %q, want %q", test.data, test.enc, got, test.want)
+      }
+   }
+}
@@ -0,0 +1,252 @@
+package app
+
+/*
+** This file contains the logic to write the scan results in a machine-readable
+** form: JSON, CSV or JUnit XML. Each uses the same classification of local and
+** remote state as the report view (see 'Classify'). The HTML report is written
+** by the code in 'htmlreport.go'.
+*/
+
+import (
+   "os"
+   "io"
+   "fmt"
+   "time"
+   "strings"
+   "strconv"
+   "io/ioutil"
+   "path/filepath"
+   "encoding/json"
+   "encoding/csv"
+   "encoding/xml"
+   "encoding/hex"
+)
+
+var ReportFormats = []string{"json", "csv", "junit", "html"}
+
+// File dialog filters for the report formats, in the same order
+var ReportFilters = []string{"JSON (*.json)", "CSV (*.csv)", "JUnit XML (*.xml)", "HTML (*.html)"}
+
+/*---------------------------------------------------------------------------
+   ReportItem [type]
+      The details written for a single file or folder.
+---------------------------------------------------------------------------*/
+
+type ReportItem struct {
+   Path        string         `json:"path"`
+   IsDir       bool           `json:"dir,omitempty"`
+   Local       ReportSide     `json:"local"`
+   Remote      ReportSide     `json:"remote"`
+   Reason      string         `json:"reason"`
+}
+
+type ReportSide struct {
+   State       string         `json:"state"`
+   Size        int64          `json:"size"`
+   ModTime     string         `json:"modified,omitempty"`
+   Hash        string         `json:"hash,omitempty"`
+}
+
+/* newReportSide
+**    Converts one side of a cache entry to report form.
+*/
+
+func newReportSide (state int, fi *FileInfo) ReportSide {
+   side := ReportSide{ State: StateNames[state], Size: fi.Size }
+   if ! fi.ModTime.IsZero() { side.ModTime = fi.ModTime.UTC().Format(time.RFC3339) }
+   if fi.Hash != nil { side.Hash = hex.EncodeToString(fi.Hash) }
+   return side
+}
+
+/*---------------------------------------------------------------------------
+   ReportItems
+      Returns the report details for each entry in the cache. If 'all' is
+   false then only the entries shown in the report view (i.e. those with a
+   difference) are included.
+---------------------------------------------------------------------------*/
+
+func ReportItems (cache *Cache, all bool) []ReportItem {
+   items := make([]ReportItem, 0)
+   cache.Walk(func (path string, fp *FilePrint) {
+      if path == "." { return }
+      if ! (all || fp.Local.Changed || fp.Remote.Changed) { return }
+      ls, rs := Classify(fp)
+      items = append(items, ReportItem{
+         Path:    filepath.ToSlash(path),
+         IsDir:   fp.Local.IsDir || fp.Remote.IsDir,
+         Local:   newReportSide(ls, &fp.Local),
+         Remote:  newReportSide(rs, &fp.Remote),
+         Reason:  Reason(fp),
+      })
+   })
+   return items
+}
+
+/*---------------------------------------------------------------------------
+   ReportFormat
+      Returns the format given, if any. Otherwise chooses a report format
+   from the extension of the output file name, defaulting to JSON.
+---------------------------------------------------------------------------*/
+
+func ReportFormat (path, format string) string {
+   if format != "" { return format }
+   switch strings.ToLower(filepath.Ext(path)) {
+      case ".csv": return "csv"
+      case ".xml": return "junit"
+      case ".html", ".htm": return "html"
+   }
+   return "json"
+}
+
+/*---------------------------------------------------------------------------
+   SaveReport
+      Writes the results from the given cache to a file, in the given format.
+   Writing the HTML report stops early, with 'E_Cancelled', if a value is sent
+   on the 'stop' channel.
+---------------------------------------------------------------------------*/
+
+func SaveReport (cache *Cache, format, path string, stop <-chan bool) error {
+   return saveFile(path, func (w io.Writer) error {
+      return WriteReport(cache, format, w, stop)
+   })
+}
+
+/* saveFile
+**    Writes a file through a temporary file in the same folder, which is
+** renamed only once it is complete. An existing file is left as it was if the
+** write fails or is cancelled.
+*/
+
+func saveFile (path string, write func (io.Writer) error) error {
+   f, err := ioutil.TempFile(filepath.Dir(path), "." + filepath.Base(path) + ".*")
+   if err != nil { return err }
+
+   err = write(f)
+   if err == nil { err = f.Chmod(0644) }
+   if cerr := f.Close(); err == nil { err = cerr }
+   if err == nil { err = os.Rename(f.Name(), path) }
+   if err != nil { os.Remove(f.Name()) }
+   return err
+}
+
+/*---------------------------------------------------------------------------
+   WriteReport
+      Writes the results from the given cache to a stream, in one of the
+   supported formats.
+---------------------------------------------------------------------------*/
+
+func WriteReport (cache *Cache, format string, w io.Writer, stop <-chan bool) error {
+   switch format {
+      case "json": return writeJSON(cache, w)
+      case "csv": return writeCSV(cache, w)
+      case "junit": return writeJUnit(cache, w)
+      case "html": return writeHTML(cache, w, stop)
+   }
+   return fmt.Errorf("Unsupported report format (%s)", format)
+}
+
+/* writeJSON
+**    Writes the differences as a single JSON document.
+*/
+
+func writeJSON (cache *Cache, w io.Writer) error {
+   enc := json.NewEncoder(w)
+   enc.SetIndent("", "  ")
+   return enc.Encode(&struct {
+      Site        string         `json:"site"`
+      Generated   time.Time      `json:"generated"`
+      Files       []ReportItem   `json:"files"`
+   }{
+      Site:       Config.Name,
+      Generated:  time.Now().UTC(),
+      Files:      ReportItems(cache, false),
+   })
+}
+
+/* writeCSV
+**    Writes the differences as comma-separated values, with a heading row.
+*/
+
+func writeCSV (cache *Cache, w io.Writer) error {
+   out := csv.NewWriter(w)
+   out.Write([]string{
+      "path",
+      "local_state", "local_size", "local_modified", "local_hash",
+      "remote_state", "remote_size", "remote_modified", "remote_hash",
+      "reason",
+   })
+   for _, it := range ReportItems(cache, false) {
+      out.Write([]string{
+         it.Path,
+         it.Local.State, strconv.FormatInt(it.Local.Size, 10), it.Local.ModTime, it.Local.Hash,
+         it.Remote.State, strconv.FormatInt(it.Remote.Size, 10), it.Remote.ModTime, it.Remote.Hash,
+         it.Reason,
+      })
+   }
+   out.Flush()
+   return out.Error()
+}
+
+/*---------------------------------------------------------------------------
+   JUnit XML types
+      Each file is reported as a test case, which fails if the local and
+   remote copies differ. Folders are not included.
+---------------------------------------------------------------------------*/
+
+type junitSuite struct {
+   XMLName     xml.Name       `xml:"testsuite"`
+   Name        string         `xml:"name,attr"`
+   Tests       int            `xml:"tests,attr"`
+   Failures    int            `xml:"failures,attr"`
+   Timestamp   string         `xml:"timestamp,attr"`
+   Cases       []junitCase    `xml:"testcase"`
+}
+
+type junitCase struct {
+   ClassName   string         `xml:"classname,attr"`
+   Name        string         `xml:"name,attr"`
+   Failure     *junitFailure  `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+   Type        string         `xml:"type,attr"`
+   Message     string         `xml:"message,attr"`
+   Text        string         `xml:",chardata"`
+}
+
+/* writeJUnit
+**    Writes all files as a JUnit XML test suite.
+*/
+
+func writeJUnit (cache *Cache, w io.Writer) error {
+   suite := junitSuite{
+      Name:       "ftpsync." + Config.Name,
+      Timestamp:  time.Now().UTC().Format("2006-01-02T15:04:05"),
+   }
+
+   for _, it := range ReportItems(cache, true) {
+      if it.IsDir { continue }
+      tc := junitCase{ ClassName: suite.Name, Name: it.Path }
+      if it.Local.State != StateNames[State__Unchanged] || it.Remote.State != StateNames[State__Unchanged] {
+         tc.Failure = &junitFailure{
+            Type:    it.Local.State + "/" + it.Remote.State,
+            Message: it.Reason,
+            Text:    fmt.Sprintf(
+               "Local:  size=%d modified=%s hash=%s\nRemote: size=%d modified=%s hash=%s\n",
+               it.Local.Size, it.Local.ModTime, it.Local.Hash,
+               it.Remote.Size, it.Remote.ModTime, it.Remote.Hash,
+            ),
+         }
+         suite.Failures++
+      }
+      suite.Cases = append(suite.Cases, tc)
+   }
+   suite.Tests = len(suite.Cases)
+
+   io.WriteString(w, xml.Header)
+   enc := xml.NewEncoder(w)
+   enc.Indent("", "  ")
+   err := enc.Encode(&suite)
+   if err == nil { _, err = io.WriteString(w, "\n") }
+   return err
+}
@@ -0,0 +1,33 @@
+package app
+
+import (
+   "io"
+   "os"
+   "errors"
+   "testing"
+   "io/ioutil"
+   "path/filepath"
+)
+
+func TestSaveFile (t *testing.T) {
+   dir := tempDir(t)
+   defer os.RemoveAll(dir)
+   path := filepath.Join(dir, "report.json")
+   writeFiles(t, dir, map[string]string{ "report.json": "old" })
+
+   // A failed write leaves the existing file, and no temporary file
+   err := saveFile(path, func (w io.Writer) error {
+      io.WriteString(w, "partial")
+      return errors.New("failed")
+   })
+   if err == nil { t.Errorf("no error from failed write") }
+   if data, _ := ioutil.ReadFile(path); string(data) != "old" { t.Errorf("after failure: got %q", data) }
+
+   if err = saveFile(path, func (w io.Writer) error { _, err := io.WriteString(w, "new"); return err }); err != nil {
+      t.Fatal(err)
+   }
+   if data, _ := ioutil.ReadFile(path); string(data) != "new" { t.Errorf("got %q", data) }
+
+   list, _ := ioutil.ReadDir(dir)
+   if len(list) != 1 { t.Errorf("got %d files, want 1", len(list)) }
+}
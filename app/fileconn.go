@@ -0,0 +1,77 @@
+package app
+
+/*
+** This file contains the 'file' scheme for the remote side, which compares the
+** local copy with another folder on this machine: for example, a mounted share,
+** an NFS export or a staged build. The folder is accessed through the same
+** interface as an FTP server.
+*/
+
+import (
+   "os"
+   "io"
+   "errors"
+   "runtime"
+   "io/ioutil"
+   "path/filepath"
+)
+
+/*---------------------------------------------------------------------------
+   dialFile
+      Helper function to "connect" to a local folder, which must exist.
+---------------------------------------------------------------------------*/
+
+func dialFile (r *RemoteSide) (FTPConn, error) {
+   conn := FileConn{}
+   info, err := os.Stat(conn.path(r.Addr.Path))
+   if err != nil { return nil, err }
+   if ! info.IsDir() { return nil, errors.New("Remote path is not a folder") }
+   return conn, nil
+}
+
+/*---------------------------------------------------------------------------
+   FileConn
+      Implements the same interface as an FTP connection, over the local
+   file system. Paths are given in URL form (with '/' separators).
+---------------------------------------------------------------------------*/
+
+type FileConn struct {}
+
+func (c FileConn) Close () error {
+   return nil
+}
+
+func (c FileConn) ReadDir (path string) ([]os.FileInfo, error) {
+   return ioutil.ReadDir(c.path(path))
+}
+
+func (c FileConn) Retrieve (path string, dest io.Writer) error {
+   f, err := os.Open(c.path(path))
+   if err != nil { return err }
+   defer f.Close()
+   
+   _, err = io.Copy(dest, f)
+   return err
+}
+
+func (c FileConn) Store (path string, src io.Reader) error {
+   f, err := os.Create(c.path(path))
+   if err != nil { return err }
+   
+   _, err = io.Copy(f, src)
+   if cerr := f.Close(); err == nil { err = cerr }
+   return err
+}
+
+/* path
+**    Converts a path from URL form to a native path. On Windows, a URL such
+** as 'file:///C:/site' has the path '/C:/site', so the leading '/' must be
+** removed.
+*/
+
+func (c FileConn) path (path string) string {
+   if runtime.GOOS == "windows" && len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+      path = path[1:]
+   }
+   return filepath.FromSlash(path)
+}
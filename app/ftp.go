@@ -9,8 +9,8 @@ import (
    "bytes"
    "errors"
    "time"
+   "net/url"
    "crypto/tls"
-   "crypto/x509"
    "github.com/secsy/goftp"
    "github.com/pkg/sftp"
    "golang.org/x/crypto/ssh"
@@ -19,34 +19,103 @@ import (
 
 /*---------------------------------------------------------------------------
    FTPConn [interface]
-      Common interface for both FTP and SFTP connections.
+      Common interface for FTP, SFTP, WebDAV, S3 and local folder connections.
 ---------------------------------------------------------------------------*/
 
 type FTPConn interface {
    Close () error
    ReadDir (string) ([]os.FileInfo, error)
    Retrieve (string, io.Writer) error
+   Store (string, io.Reader) error
+}
+
+// Schemes for the remote address, with their names as shown in the site
+// settings
+var Schemes = []string{"ftp", "ftps", "ftps-implicit", "sftp", "dav", "davs", "s3", "file"}
+var SchemeNames = []string{
+   "FTP (insecure)", "FTPS with explicit TLS", "FTPS with implicit TLS", "SFTP",
+   "WebDAV (insecure)", "WebDAV over HTTPS", "S3 bucket", "Local folder",
+}
+
+/*---------------------------------------------------------------------------
+   RemoteSide [type]
+      The details needed to connect to one side of a site: the remote copy,
+   or a source that is another remote copy. The options under 'Advanced' are
+   those of the site; the address, password and trusted keys are kept apart
+   for each side.
+---------------------------------------------------------------------------*/
+
+type RemoteSide struct {
+   Site        *SiteConfig
+   Addr        *url.URL
+   password    *string        // as entered, for the session
+   hostKey     *[]byte        // SSH host key
+   pins        *[]CertPin     // trusted TLS server keys
+   expiryWarned *bool
+   timeOffset  *int           // FTP server time zone, if detected
+   accessKey,                 // S3 keys set for the site, if any
+   secret      string
+}
+
+/* remoteSide
+**    Returns the remote copy of the site, as a side to connect to.
+*/
+
+func (c *SiteConfig) remoteSide () *RemoteSide {
+   return &RemoteSide{
+      Site:          c,
+      Addr:          c.RemoteAddr,
+      password:      &c.password,
+      hostKey:       &c.ServerKey,
+      pins:          &c.CertPins,
+      expiryWarned:  &c.expiryWarned,
+      timeOffset:    &c.FTP.TimeOffset,
+      accessKey:     c.AccessKey,
+      secret:        c.Secret,
+   }
 }
 
 /*---------------------------------------------------------------------------
    DialRemote
       Detects the type of FTP/SFTP connection from the remote URL 'scheme'
    and returns an active connection that supports the abstract interface
-   above.
+   above. Files fetched or stored on the connection are kept to the
+   bandwidth limit (see throttle.go).
 ---------------------------------------------------------------------------*/
 
 func DialRemote () (FTPConn, error) {
-   switch (Config.RemoteAddr.Scheme) {
-      case "ftp", "ftps": {
-         return dialFTP()
+   return dialSide(Config.remoteSide())
+}
+
+/* dialSide
+**    Connects to one side of the current site, as for 'DialRemote'.
+*/
+
+func dialSide (r *RemoteSide) (FTPConn, error) {
+   var conn FTPConn
+   var err error
+   switch (r.Addr.Scheme) {
+      case "ftp", "ftps", "ftps-implicit": {
+         conn, err = dialFTP(r)
       }
       case "sftp": {
-         return dialSFTP()
+         conn, err = dialSFTP(r)
+      }
+      case "dav", "davs": {
+         conn, err = dialDAV(r)
+      }
+      case "s3": {
+         conn, err = dialS3(r)
+      }
+      case "file": {
+         conn, err = dialFile(r)
       }
       default: {
-         return nil, E_BadScheme()
+         return nil, E_BadScheme(r.Addr.Scheme)
       }
    }
+   if err != nil { return nil, err }
+   return throttledConn{ conn }, nil
 }
 
 /*---------------------------------------------------------------------------
@@ -54,8 +123,23 @@ func DialRemote () (FTPConn, error) {
       Returns customised error for unsupported scheme.
 ---------------------------------------------------------------------------*/
 
-func E_BadScheme () error {
-   return fmt.Errorf("Unsupported scheme (%s) for remote address", Config.RemoteAddr.Scheme)
+func E_BadScheme (scheme string) error {
+   return fmt.Errorf("Unsupported scheme (%s) for remote address", scheme)
+}
+
+/* getPassword
+**    Returns the password for a side: from its address, else as entered
+** before in this session, else as asked for now.
+*/
+
+func (r *RemoteSide) getPassword () (string, error) {
+   if pwd, ok := r.Addr.User.Password(); ok { return pwd, nil }
+   if *r.password == "" {
+      pwd, err := promptForPassword(r.Addr.Host)
+      if err != nil { return "", err }
+      *r.password = pwd
+   }
+   return *r.password, nil
 }
 
 /*---------------------------------------------------------------------------
@@ -64,102 +148,134 @@ func E_BadScheme () error {
    without TLS).
 ---------------------------------------------------------------------------*/
 
-func dialFTP () (FTPConn, error) {
-   var err error
+func dialFTP (r *RemoteSide) (FTPConn, error) {
    if Opt.Verbose { log.Println("Opening FTP session") }
    
-   user := Config.RemoteAddr.User.Username()
-   pwd, ok := Config.RemoteAddr.User.Password()
-   if ! ok {
-      pwd = Config.password
-      if pwd == "" {
-         pwd, err = promptForPassword()
-         if err != nil { return nil, err }
-         Config.password = pwd
-      }
-   }
+   user := r.Addr.User.Username()
+   pwd, err := r.getPassword()
+   if err != nil { return nil, err }
    
+   opts := r.Site.FTP
    config := goftp.Config{
       User:                user,
       Password:            pwd,
       ConnectionsPerHost:  1,
       Timeout:             time.Second * 20,
+      ActiveTransfers:     opts.Mode == FTPMode__Active,
+      ActiveListenAddr:    opts.ActiveAddr,
+      DisableEPSV:         opts.Mode == FTPMode__PASV,
+      ForceEPSV:           opts.Mode == FTPMode__EPSV,
+      IPv6Lookup:          opts.IPv6,
    }
    
-   if Config.RemoteAddr.Scheme == "ftps" {
-      config.TLSConfig = &tls.Config{
-         ServerName:             Config.RemoteAddr.Host,
-         VerifyPeerCertificate:  vetServerTrust,
-         InsecureSkipVerify:     true,
-      }
+   dial, err := proxyDialer(r.Site)
+   if err != nil { return nil, err }
+   if dial != nil {
+      if config.ActiveTransfers { return nil, errors.New("Active mode cannot be used through a proxy") }
+      config.Dialer = dial
+   }
+   
+   host := r.host("21")
+   switch r.Addr.Scheme {
+      case "ftps-implicit":
+         config.TLSMode = goftp.TLSImplicit
+         host = r.host("990")
+         fallthrough
+      case "ftps":
+         config.TLSConfig, err = tlsConfig(r)
+         if err != nil { return nil, err }
+         config.ClearData = r.Site.TLS.ClearData
    }
    
-   conn, err := goftp.DialConfig(config, Config.RemoteAddr.Host)
+   client, err := goftp.DialConfig(config, host)
    if err != nil { return nil, err }
+   conn := &FTPClient{ client, time.Duration(*r.timeOffset) * time.Minute }
    
-   _, err = conn.ReadDir(Config.RemoteAddr.Path)
+   list, err := conn.ReadDir(r.Addr.Path)
    if err != nil {
       conn.Close(); return nil, err
    }
    
+   if opts.DetectOffset && conn.detectOffset(r.Addr.Path, list) {
+      *r.timeOffset = int(conn.offset / time.Minute)
+   }
+   
    return conn, nil
 }
 
 /*---------------------------------------------------------------------------
-   vetServerTrust
-      Called to vet the FTPS server certificate, in place of normal checking
-   of trust chains. Attempts to verify the chain of trust from the server's
-   given certificates. If the cert is verified then of course we allow it,
-   but if not then we ask the user if they want to trust it. This is normally
-   the case if the cert is 'self-signed'.
+   FTPOptions [type]
+      Settings for FTP (and FTPS) connections.
 ---------------------------------------------------------------------------*/
 
-func vetServerTrust (raw [][]byte, verified [][]*x509.Certificate) error {
-   certs, err := x509.ParseCertificates(raw[0])
-   if err != nil { return err }
-   
-   leaf := certs[0]
-   if Config.ServerKey != nil && bytes.Equal(Config.ServerKey, leaf.Signature) {
-      return nil // already decided to trust
+type FTPOptions struct {
+   Mode        int            // type of data connection (see below)
+   ActiveAddr  string         // active mode: address to listen on, if not
+                              // that of the control connection
+   IPv6        bool           // use IPv6 addresses found for the server name
+   TimeOffset  int            // server time zone for 'LIST', minutes east of UTC
+   DetectOffset bool          // detect the above from 'MDTM' when connecting
+}
+
+const (
+   FTPMode__Passive = iota    // EPSV, falling back to PASV
+   FTPMode__PASV
+   FTPMode__EPSV
+   FTPMode__Active
+)
+
+// Names for each mode, as shown in the site settings
+var FTPModeNames = []string{"Passive", "Passive (PASV only)", "Passive (EPSV only)", "Active"}
+
+/* host
+**    Returns the server address (host and port) for a side, using the given
+** port if none is set.
+*/
+
+func (r *RemoteSide) host (port string) string {
+   if p := r.Addr.Port(); p != "" { port = p }
+   return net.JoinHostPort(r.Addr.Hostname(), port)
+}
+
+/*---------------------------------------------------------------------------
+   TLSPolicy [type]
+      TLS settings for a site, used for FTPS and WebDAV over HTTPS.
+---------------------------------------------------------------------------*/
+
+type TLSPolicy struct {
+   MinVersion  uint16         // zero for the Go default
+   ClientCert,                // PEM files for client authentication (the
+   ClientKey   string         // key may be in the certificate file)
+   ClearData   bool           // FTPS only: don't encrypt data connections
+}
+
+// Minimum TLS versions, with their names as shown in the site settings
+var TLSVersions = []uint16{0, tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+var TLSVersionNames = []string{"Default", "TLS 1.0", "TLS 1.1", "TLS 1.2", "TLS 1.3"}
+
+/*---------------------------------------------------------------------------
+   tlsConfig
+      Returns the TLS configuration for one side of the site, following the
+   site's TLS policy. The server certificate is checked by 'vetServerTrust'.
+---------------------------------------------------------------------------*/
+
+func tlsConfig (r *RemoteSide) (*tls.Config, error) {
+   policy := r.Site.TLS
+   config := &tls.Config{
+      ServerName:             r.Addr.Hostname(),
+      VerifyPeerCertificate:  r.vetServerTrust,
+      InsecureSkipVerify:     true,
+      MinVersion:             policy.MinVersion,
    }
    
-   pool := x509.NewCertPool()
-   for _, c := range certs[1:] { pool.AddCert(c) }
-   
-   _, err = leaf.Verify(x509.VerifyOptions{
-      DNSName:       Config.RemoteAddr.Host,
-      Roots:         nil, // use system roots
-      Intermediates: pool,
-   })
-   if err == nil { return nil }
-   
-   box := widgets.NewQMessageBox2(
-      widgets.QMessageBox__Warning,
-      "TLS Certificate",
-      fmt.Sprintf(
-         "The security certificate from %s could not be verified.\n%s\n",
-         Config.RemoteAddr.Host,
-         err.Error(),
-      ),
-      widgets.QMessageBox__Ok | widgets.QMessageBox__Cancel,
-      nil, 0,
-   )
-   box.SetDetailedText(
-      fmt.Sprintf(
-         "Certificate details:\n  Subject: %s\n  Issuer:  %s\n",
-         leaf.Subject.String(),
-         leaf.Issuer.String(),
-      ),
-   )
-   box.SetInformativeText("Do you trust this server?")
-   
-   answer := box.Exec()
-   if answer == int(widgets.QMessageBox__Ok) {
-      Config.ServerKey = leaf.Signature
-      return nil
+   if policy.ClientCert != "" {
+      key := policy.ClientKey
+      if key == "" { key = policy.ClientCert }
+      cert, err := tls.LoadX509KeyPair(policy.ClientCert, key)
+      if err != nil { return nil, fmt.Errorf("Client certificate: %v", err) }
+      config.Certificates = []tls.Certificate{cert}
    }
-   
-   return fmt.Errorf("TLS certificate not trusted")
+   return config, nil
 }
 
 /*---------------------------------------------------------------------------
@@ -167,28 +283,88 @@ func vetServerTrust (raw [][]byte, verified [][]*x509.Certificate) error {
       Helper function to create and return an SSH FTP session (SFTP).
 ---------------------------------------------------------------------------*/
 
-func dialSFTP () (FTPConn, error) {
-   var err error
+func dialSFTP (r *RemoteSide) (FTPConn, error) {
    if Opt.Verbose { log.Println("Opening SFTP session") }
    
-   user := Config.RemoteAddr.User.Username()
-   pwd, ok := Config.RemoteAddr.User.Password()
-   if ! ok {
-      pwd, err = promptForPassword()
+   user := r.Addr.User.Username()
+   pwd, err := r.getPassword()
+   if err != nil { return nil, err }
+   
+   dial, err := siteDialer(r.Site)
+   if err != nil { return nil, err }
+   
+   var jump *ssh.Client
+   if r.Site.JumpHost != "" {
+      jump, err = dialJump(r, dial)
       if err != nil { return nil, err }
+      dial = jump.Dial
    }
    
-   conn, err := ssh.Dial("tcp", Config.RemoteAddr.Host, &ssh.ClientConfig{
+   conn, err := dialSSH(dial, r.host("22"), &ssh.ClientConfig{
       User:             user,
       Auth:             []ssh.AuthMethod{ ssh.Password(pwd) },
-      HostKeyCallback:  vetHostKey,
+      HostKeyCallback:  hostKeyCheck(r.hostKey),
    })
-   if err != nil { return nil, err }
+   if err == nil {
+      var client *sftp.Client
+      client, err = sftp.NewClient(conn)
+      if err == nil { return SFTPConn{ Client: client, ssh: conn, jump: jump }, nil }
+      conn.Close()
+   } else {
+      *r.password = "" // ask again next time
+   }
+   if jump != nil { jump.Close() }
+   return nil, err
+}
+
+/* dialJump
+**    Opens an SSH connection to the jump host for the site, through which
+** the SFTP server is reached (as for the 'ProxyJump' option of SSH). The jump
+** host is given as '[user@]host[:port]'; the username defaults to that for
+** the side being reached. The password is asked for once in a session, and
+** asked for again only if the login fails.
+*/
+
+func dialJump (r *RemoteSide, dial Dialer) (*ssh.Client, error) {
+   site := r.Site
+   addr, err := url.Parse("ssh://" + site.JumpHost)
+   if err != nil { return nil, fmt.Errorf("Jump host: %v", err) }
+   user := addr.User.Username()
+   if user == "" { user = r.Addr.User.Username() }
+   
+   pwd, ok := addr.User.Password()
+   if ! ok {
+      pwd = site.jumpPassword
+      if pwd == "" {
+         pwd, err = promptForPassword(addr.Host)
+         if err != nil { return nil, err }
+         site.jumpPassword = pwd
+      }
+   }
    
-   client, err := sftp.NewClient(conn)
+   port := addr.Port(); if port == "" { port = "22" }
+   client, err := dialSSH(dial, net.JoinHostPort(addr.Hostname(), port), &ssh.ClientConfig{
+      User:             user,
+      Auth:             []ssh.AuthMethod{ ssh.Password(pwd) },
+      HostKeyCallback:  hostKeyCheck(&site.JumpKey),
+   })
+   if err != nil { site.jumpPassword = "" }
+   return client, err
+}
+
+/* dialSSH
+**    Opens an SSH connection over a connection from the given dialer.
+*/
+
+func dialSSH (dial Dialer, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+   conn, err := dial("tcp", addr)
    if err != nil { return nil, err }
    
-   return SFTPConn{client}, nil
+   c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+   if err != nil {
+      conn.Close(); return nil, err
+   }
+   return ssh.NewClient(c, chans, reqs), nil
 }
 
 /*---------------------------------------------------------------------------
@@ -199,6 +375,15 @@ func dialSFTP () (FTPConn, error) {
 
 type SFTPConn struct {
    *sftp.Client
+   ssh,
+   jump        *ssh.Client    // jump host, if any
+}
+
+func (c SFTPConn) Close () error {
+   err := c.Client.Close()
+   c.ssh.Close()
+   if c.jump != nil { c.jump.Close() }
+   return err
 }
 
 func (c SFTPConn) Retrieve (path string, dest io.Writer) error {
@@ -210,18 +395,27 @@ func (c SFTPConn) Retrieve (path string, dest io.Writer) error {
    return err
 }
 
+func (c SFTPConn) Store (path string, src io.Reader) error {
+   f, err := c.Client.Create(path)
+   if err != nil { return err }
+   
+   _, err = io.Copy(f, src)
+   if cerr := f.Close(); err == nil { err = cerr }
+   return err
+}
+
 /*---------------------------------------------------------------------------
    promptForPassword
       Helper function to prompt the user to enter a password, if this has
    been omitted from the remote URL.
 ---------------------------------------------------------------------------*/
 
-func promptForPassword () (pwd string, err error) {
+func promptForPassword (host string) (pwd string, err error) {
    ok := false
    pwd = widgets.QInputDialog_GetText(
       nil,
       "Password",
-      "Enter password for " + Config.RemoteAddr.Host,
+      "Enter password for " + host,
       widgets.QLineEdit__Password,
       "",
       &ok,
@@ -232,15 +426,22 @@ func promptForPassword () (pwd string, err error) {
 }
 
 /*---------------------------------------------------------------------------
-   vetHostKey
-      Called to vet the SSH server key. If we have connected before, then
-   the key should be the same as last time. Otherwise - or if different -
-   we need to ask the user if they'll trust this key.
+   hostKeyCheck
+      Returns a function to vet an SSH server key, against the key saved
+   in the given place (for the server or the jump host). If we have
+   connected before, then the key should be the same as last time. Otherwise
+   - or if different - we need to ask the user if they'll trust this key.
 ---------------------------------------------------------------------------*/
 
-func vetHostKey (hostname string, remote net.Addr, key ssh.PublicKey) error {
+func hostKeyCheck (saved *[]byte) ssh.HostKeyCallback {
+   return func (hostname string, remote net.Addr, key ssh.PublicKey) error {
+      return vetHostKey(saved, hostname, remote, key)
+   }
+}
+
+func vetHostKey (saved *[]byte, hostname string, remote net.Addr, key ssh.PublicKey) error {
    keyBytes := key.Marshal()
-   if Config.ServerKey != nil && bytes.Equal(Config.ServerKey, keyBytes) { return nil }
+   if *saved != nil && bytes.Equal(*saved, keyBytes) { return nil }
    
    box := widgets.NewQMessageBox2(
       widgets.QMessageBox__Warning,
@@ -257,7 +458,7 @@ func vetHostKey (hostname string, remote net.Addr, key ssh.PublicKey) error {
    
    answer := box.Exec()
    if answer == int(widgets.QMessageBox__Ok) {
-      Config.ServerKey = keyBytes
+      *saved = keyBytes
       return nil
    }
    
@@ -0,0 +1,123 @@
+package app
+
+/*
+** This file contains the handling of file times from an FTP server. Where the
+** server supports 'MLSD', the times are exact and in UTC. Otherwise, the times
+** from 'LIST' are in the server's local time and only to the minute (or, for
+** older files, to the day). These are corrected by the time zone offset set for
+** the site (which may be detected from 'MDTM'), and marked with their precision
+** so that a scan does not take a rounded time as a change.
+*/
+
+import (
+   "os"
+   "log"
+   "time"
+   "regexp"
+   "strings"
+   "path/filepath"
+   "github.com/secsy/goftp"
+)
+
+// Time of day in a 'LIST' entry, e.g. "Jul 28 05:03"
+var listTimeOfDay = regexp.MustCompile(`\s\d{1,2}:\d{2}\s`)
+
+/*---------------------------------------------------------------------------
+   FTPClient [type]
+      Wrapper for an FTP client connection, which corrects the times of
+   files listed by 'LIST' for the server's time zone.
+---------------------------------------------------------------------------*/
+
+type FTPClient struct {
+   *goftp.Client
+   offset      time.Duration  // server time zone, east of UTC
+}
+
+func (c *FTPClient) ReadDir (path string) ([]os.FileInfo, error) {
+   list, err := c.Client.ReadDir(path)
+   if err != nil { return nil, err }
+
+   for n, info := range list {
+      if p := listPrecision(info); p > 0 {
+         list[n] = &listedFile{ info, info.ModTime().Add(-c.offset), p }
+      }
+   }
+   return list, nil
+}
+
+/* listPrecision
+**    Returns the precision of the time for a file listed by 'LIST': either a
+** minute or a day. Returns zero for a file listed by 'MLSD'.
+*/
+
+func listPrecision (info os.FileInfo) time.Duration {
+   raw, ok := info.Sys().(string)
+   if ! ok { return 0 }
+   facts := strings.SplitN(raw, " ", 2)[0]
+   switch {
+      case strings.Contains(facts, "="): return 0 // MLSD
+      case listTimeOfDay.MatchString(raw): return time.Minute
+   }
+   return 24 * time.Hour
+}
+
+/* listedFile
+**    Details of a file listed by 'LIST', with the corrected time.
+*/
+
+type listedFile struct {
+   os.FileInfo
+   mtime       time.Time
+   precision   time.Duration
+}
+
+func (f *listedFile) ModTime () time.Time { return f.mtime }
+func (f *listedFile) Precision () time.Duration { return f.precision }
+
+/*---------------------------------------------------------------------------
+   FTPClient::detectOffset
+      Works out the server's time zone by comparing the listed time of a
+   file with its time from 'MDTM' (which is in UTC). The offset is rounded
+   to a quarter of an hour. Returns false if there is no file with a time
+   to the minute in the listing, or if the server does not support 'MDTM'.
+---------------------------------------------------------------------------*/
+
+func (c *FTPClient) detectOffset (dir string, list []os.FileInfo) bool {
+   for _, info := range list {
+      f, ok := info.(*listedFile)
+      if ! ok || f.IsDir() || f.precision != time.Minute { continue }
+
+      exact, err := c.Client.ModTime(filepath.Join(dir, f.Name()))
+      if err != nil { return false }
+
+      // The listed time, before correction, is the server's local time
+      c.offset = f.FileInfo.ModTime().Sub(exact).Round(15 * time.Minute)
+      if Opt.Verbose { log.Printf("Server time offset: %v (from %s)\n", c.offset, f.Name()) }
+      return true
+   }
+   return false
+}
+
+/*---------------------------------------------------------------------------
+   Scanner::sameTime
+      Compares the time of a remote file with that recorded before, allowing
+   for the precision of the listing and the tolerance set for the site.
+---------------------------------------------------------------------------*/
+
+func (s *Scanner) sameTime (was time.Time, info os.FileInfo) bool {
+   window := s.Tolerance
+   if p, ok := info.(interface{ Precision () time.Duration }); ok && p.Precision() > window {
+      window = p.Precision()
+   }
+   return withinTime(was, info.ModTime(), window)
+}
+
+/* withinTime
+**    Returns true if two times differ by no more than the given window.
+*/
+
+func withinTime (a, b time.Time, window time.Duration) bool {
+   diff := a.Sub(b)
+   if diff < 0 { diff = -diff }
+   return diff <= window
+}
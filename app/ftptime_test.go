@@ -0,0 +1,53 @@
+package app
+
+import (
+   "os"
+   "time"
+   "testing"
+)
+
+// A file listed by the server, with the raw listing line
+type listing struct {
+   os.FileInfo
+   raw         interface{}
+}
+
+func (l listing) Sys () interface{} { return l.raw }
+
+func TestListPrecision (t *testing.T) {
+   tests := []struct {
+      raw         interface{}
+      want        time.Duration
+   }{
+      { "type=file;size=12;modify=20200728050312; index.html", 0 },
+      { "-rw-r--r--   1 user  group  12 Jul 28 05:03 index.html", time.Minute },
+      { "-rw-r--r--   1 user  group  12 Jul 28  2019 index.html", 24 * time.Hour },
+      { nil, 0 },
+   }
+   for _, test := range tests {
+      if got := listPrecision(listing{ raw: test.raw }); got != test.want {
+         t.Errorf("%q: got %v, want %v", test.raw, got, test.want)
+      }
+   }
+}
+
+func TestWithinTime (t *testing.T) {
+   at := time.Date(2020, 7, 28, 5, 3, 0, 0, time.UTC)
+   tests := []struct {
+      b           time.Time
+      window      time.Duration
+      want        bool
+   }{
+      { at, 0, true },
+      { at.Add(time.Second), 0, false },
+      { at.Add(59 * time.Second), time.Minute, true },
+      { at.Add(-time.Minute), time.Minute, true },
+      { at.Add(-61 * time.Second), time.Minute, false },
+      { at.Add(23 * time.Hour), 24 * time.Hour, true },
+   }
+   for _, test := range tests {
+      if got := withinTime(at, test.b, test.window); got != test.want {
+         t.Errorf("%v within %v: got %v", test.b.Sub(at), test.window, got)
+      }
+   }
+}
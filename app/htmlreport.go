@@ -0,0 +1,215 @@
+package app
+
+/*
+** This file contains the logic to write a stand-alone HTML report of the scan
+** results, suitable for sending to a client. The report is a single file, with
+** no external style sheets or images, and includes the changed lines of each
+** text file, with a few lines of context, in the same way as a patch.
+*/
+
+import (
+   "io"
+   "fmt"
+   "html"
+   "time"
+   "strings"
+   "net/url"
+   "path/filepath"
+)
+
+// Style sheet for the HTML report
+const reportStyle = `
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 0.2em 0.8em; border-bottom: 1px solid #ddd; }
+td.state { text-align: center; }
+.changed { color: #1f6fb5; }
+.conflict { color: #b51919; font-weight: bold; }
+.missing { color: #8a5a00; }
+.diff { font-family: monospace; white-space: pre-wrap; border: 1px solid #ccc; padding: 0.5em; background: #fafafa; }
+.diff .hunk { color: #888; }
+.diff .del { background: #fbe3e3; }
+.diff .ins { background: #e0f2f4; }
+.note { font-style: italic; color: #666; }
+`
+
+/*---------------------------------------------------------------------------
+   writeHTML
+      Writes a stand-alone HTML report. This fetches the remote copy of each
+   changed text file, so must open a connection to the server (and to the
+   source, if it is a remote copy). Files beyond the view size limit are not
+   compared. It may be stopped between files.
+      For the results of a check against a manifest (a transient cache), the
+   differences are only listed, as there is no source to compare with.
+---------------------------------------------------------------------------*/
+
+func writeHTML (cache *Cache, w io.Writer, stop <-chan bool) error {
+   var conn, src FTPConn
+   var err error
+   details := ! cache.Transient()
+   if details {
+      conn, err = DialRemote()
+      if err != nil { return err }
+      defer conn.Close()
+      src, err = openSource()
+      if err != nil { return err }
+      if src != nil { defer src.Close() }
+   }
+
+   s := NewScanner(cache, conn)
+   items := ReportItems(cache, false)
+
+   // Count each type of difference
+   counts := make(map[string]int)
+   for _, it := range items {
+      if it.IsDir { continue }
+      switch {
+         case it.Local.State == StateNames[State__Conflict]: counts["Conflicts"]++
+         case it.Local.State == StateNames[State__Missing]: counts["Missing locally"]++
+         case it.Remote.State == StateNames[State__Missing]: counts["Missing remotely"]++
+         case it.Local.State == StateNames[State__Changed]: counts["Changed locally"]++
+         case it.Remote.State == StateNames[State__Changed]: counts["Changed remotely"]++
+      }
+   }
+
+   fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n")
+   fmt.Fprintf(w, "<title>%s - ftpsync report</title>\n", html.EscapeString(Config.Name))
+   fmt.Fprintf(w, "<style>%s</style>\n</head>\n<body>\n", reportStyle)
+   fmt.Fprintf(w, "<h1>%s</h1>\n", html.EscapeString(Config.Name))
+   source := sourceLabel() + ": " + html.EscapeString(sourceName())
+   if ! details { source = "Checked against a signed manifest" }
+   fmt.Fprintf(
+      w, "<p>%s<br>Remote: %s<br>Generated: %s</p>\n",
+      source,
+      html.EscapeString(remoteName()),
+      time.Now().Format("2 Jan 2006 15:04 MST"),
+   )
+
+   // Summary
+   fmt.Fprintf(w, "<h2>Summary</h2>\n<table>\n")
+   for _, k := range []string{
+      "Changed locally", "Changed remotely", "Conflicts", "Missing locally", "Missing remotely",
+   } {
+      fmt.Fprintf(w, "<tr><td>%s</td><td>%d</td></tr>\n", k, counts[k])
+   }
+   fmt.Fprintf(w, "</table>\n")
+
+   if len(items) == 0 {
+      fmt.Fprintf(w, "<p>No differences were found.</p>\n</body>\n</html>\n")
+      return nil
+   }
+
+   // List of differences, with links to the details below
+   fmt.Fprintf(w, "<h2>Differences</h2>\n<table>\n")
+   fmt.Fprintf(w, "<tr><th>Path</th><th>Local</th><th>Remote</th><th>Reason</th></tr>\n")
+   for n, it := range items {
+      name := html.EscapeString(it.Path)
+      if details && ! it.IsDir { name = fmt.Sprintf("<a href=\"#f%d\">%s</a>", n, name) }
+      fmt.Fprintf(
+         w, "<tr><td>%s</td><td class=\"state %s\">%s</td><td class=\"state %s\">%s</td><td>%s</td></tr>\n",
+         name, it.Local.State, it.Local.State, it.Remote.State, it.Remote.State, it.Reason,
+      )
+   }
+   fmt.Fprintf(w, "</table>\n")
+   if ! details {
+      _, err = fmt.Fprintf(w, "</body>\n</html>\n")
+      return err
+   }
+
+   // Details for each file
+   fmt.Fprintf(w, "<h2>Details</h2>\n")
+   for n, it := range items {
+      if it.IsDir { continue }
+      select {
+         case _ = <-stop:
+            return E_Cancelled
+         default:
+            // continue
+      }
+      qMain.ShowStatus(it.Path)
+
+      fmt.Fprintf(w, "<h3 id=\"f%d\">%s</h3>\n", n, html.EscapeString(it.Path))
+      fmt.Fprintf(
+         w, "<p>Local: %s<br>Remote: %s</p>\n",
+         describeSide(&it.Local), describeSide(&it.Remote),
+      )
+
+      path := filepath.FromSlash(it.Path)
+      switch {
+         case it.Local.State == StateNames[State__Missing] || it.Remote.State == StateNames[State__Missing]:
+            continue
+         case s.isBinary(path):
+            fmt.Fprintf(w, "<p class=\"note\">Binary file; differences not shown.</p>\n")
+            continue
+         case it.Local.Size > ViewLimit() || it.Remote.Size > ViewLimit():
+            fmt.Fprintf(w, "<p class=\"note\">Too large to compare; differences not shown.</p>\n")
+            continue
+      }
+
+      local, remote, err := FetchFile(conn, src, path)
+      if err != nil {
+         fmt.Fprintf(w, "<p class=\"note\">Cannot compare: %s</p>\n", html.EscapeString(err.Error()))
+         continue
+      }
+      fmt.Fprintf(w, "<div class=\"diff\">%s</div>\n", hunkHtml(local, remote))
+   }
+
+   _, err = fmt.Fprintf(w, "</body>\n</html>\n")
+   return err
+}
+
+/* hunkHtml
+**    Returns the changed lines between two texts, as HTML, grouped into hunks
+** with a few lines of context, as in a patch.
+*/
+
+func hunkHtml (local, remote string) string {
+   var buf strings.Builder
+   lines := patchLines(local, remote)
+   for _, h := range patchHunks(lines) {
+      fmt.Fprintf(&buf, "<div class=\"hunk\">%s</div>", hunkHeader(lines, h[0], h[1]))
+      for _, l := range lines[h[0]:h[1]] {
+         class := "same"
+         switch l.op {
+            case '-': class = "del"
+            case '+': class = "ins"
+         }
+         text := html.EscapeString(strings.TrimRight(l.text, "\r\n"))
+         fmt.Fprintf(&buf, "<div class=\"%s\">%c%s</div>", class, l.op, text)
+      }
+   }
+   return buf.String()
+}
+
+/* describeSide
+**    Returns a short HTML description of the local or remote copy of a file.
+*/
+
+func describeSide (side *ReportSide) string {
+   if side.State == StateNames[State__Missing] {
+      return "<span class=\"missing\">not found</span>"
+   }
+   text := fmt.Sprintf("<span class=\"%s\">%s</span>, %d bytes", side.State, side.State, side.Size)
+   if side.ModTime != "" { text += ", modified " + side.ModTime }
+   return text
+}
+
+/* sourceLabel
+**    Returns the heading for the source of the current site.
+*/
+
+func sourceLabel () string {
+   if Config.RemoteSource() != nil { return "Source" }
+   return "Local folder"
+}
+
+/* remoteName
+**    Returns the remote address for the current site, without the password
+** (if any).
+*/
+
+func remoteName () string {
+   u := *Config.RemoteAddr
+   if u.User != nil { u.User = url.User(u.User.Username()) }
+   return strings.TrimSuffix(u.String(), "/")
+}
@@ -0,0 +1,23 @@
+package app
+
+import (
+   "strings"
+   "testing"
+)
+
+func TestHunkHtml (t *testing.T) {
+   local := strings.Repeat("same\n", 10) + "<old>\n" + strings.Repeat("same\n", 10)
+   remote := strings.Repeat("same\n", 10) + "<new>\n" + strings.Repeat("same\n", 10)
+
+   got := hunkHtml(local, remote)
+   for _, want := range []string{
+      `<div class="hunk">@@ -8,7 +8,7 @@</div>`,
+      `<div class="del">-&lt;old&gt;</div>`,
+      `<div class="ins">+&lt;new&gt;</div>`,
+   } {
+      if ! strings.Contains(got, want) { t.Errorf("missing %s in %s", want, got) }
+   }
+   // Only the context lines are included, not the whole file
+   if n := strings.Count(got, `class="same"`); n != 6 { t.Errorf("got %d context lines, want 6", n) }
+   if got := hunkHtml(local, local); got != "" { t.Errorf("same text: got %q", got) }
+}
@@ -0,0 +1,170 @@
+package app
+
+/*
+** This file contains the logic to apply a single block of changes ("hunk")
+** from the file viewer to either copy of a file: pushing the local version of
+** the lines to the remote copy, or pulling the remote version into the local
+** copy. The fingerprint for the file is then brought up to date.
+*/
+
+import (
+   "os"
+   "io"
+   "bytes"
+   "errors"
+   "strings"
+   "io/ioutil"
+   "path/filepath"
+   dmp "github.com/sergi/go-diff/diffmatchpatch"
+)
+
+/*---------------------------------------------------------------------------
+   Hunk [type]
+      A block of changed lines, between two runs of unchanged lines. Start
+   positions count from zero. The lines include their line endings.
+---------------------------------------------------------------------------*/
+
+type Hunk struct {
+   LocalStart,
+   RemoteStart int
+   Local,
+   Remote      []string
+}
+
+/*---------------------------------------------------------------------------
+   Hunks
+      Returns the blocks of changes between the local and remote copies of
+   a file, in order. These are the same blocks that are shown (and numbered)
+   in the side-by-side view.
+---------------------------------------------------------------------------*/
+
+func Hunks (local, remote string) []Hunk {
+   hunks := make([]Hunk, 0)
+   ln, rn := 0, 0
+   var cur *Hunk
+
+   for _, d := range LineDiff(local, remote) {
+      lines := strings.SplitAfter(d.Text, "\n")
+      if lines[len(lines) - 1] == "" { lines = lines[:len(lines) - 1] }
+
+      if d.Type == dmp.DiffEqual {
+         cur = nil
+         ln += len(lines); rn += len(lines)
+         continue
+      }
+      if cur == nil {
+         hunks = append(hunks, Hunk{ LocalStart: ln, RemoteStart: rn })
+         cur = &hunks[len(hunks) - 1]
+      }
+      if d.Type == dmp.DiffDelete {
+         cur.Local = append(cur.Local, lines...)
+         ln += len(lines)
+      } else {
+         cur.Remote = append(cur.Remote, lines...)
+         rn += len(lines)
+      }
+   }
+   return hunks
+}
+
+/*---------------------------------------------------------------------------
+   Hunk::Push, Hunk::Pull
+      Return the new remote copy, with the local version of the hunk, or the
+   new local copy, with the remote version of the hunk.
+---------------------------------------------------------------------------*/
+
+func (h *Hunk) Push (remote string) string {
+   return replaceLines(remote, h.RemoteStart, len(h.Remote), h.Local)
+}
+
+func (h *Hunk) Pull (local string) string {
+   return replaceLines(local, h.LocalStart, len(h.Local), h.Remote)
+}
+
+/* replaceLines
+**    Replaces 'count' lines of a text, starting at line 'start' (from zero),
+** with the given lines.
+*/
+
+func replaceLines (text string, start, count int, with []string) string {
+   lines := strings.SplitAfter(text, "\n")
+   if lines[len(lines) - 1] == "" { lines = lines[:len(lines) - 1] }
+
+   var buf strings.Builder
+   for _, l := range lines[:start] { buf.WriteString(l) }
+   for _, l := range with { buf.WriteString(l) }
+   for _, l := range lines[start+count:] { buf.WriteString(l) }
+   return buf.String()
+}
+
+/*---------------------------------------------------------------------------
+   StoreLocal
+      Replaces the local copy of a file with new text, keeping its mode, and
+   updates its fingerprint in the given cache. Where the source is another
+   remote copy, the new text is uploaded to it instead, using the open
+   connection given (which is nil for a local folder).
+---------------------------------------------------------------------------*/
+
+func StoreLocal (cache *Cache, src FTPConn, path, text string) error {
+   if src != nil { return storeSource(cache, src, path, text) }
+   full := filepath.Join(Config.Source, path)
+   info, err := os.Stat(full)
+   if err != nil { return err }
+
+   err = ioutil.WriteFile(full, []byte(text), info.Mode())
+   if err != nil { return err }
+
+   info, err = os.Stat(full)
+   if err != nil { return err }
+
+   s := NewScanner(cache, nil)
+   return s.CheckLocal(path, info)
+}
+
+/*---------------------------------------------------------------------------
+   StoreRemote
+      Uploads new text for the remote copy of a file and updates its
+   fingerprint in the given cache. The hash is computed from the text, as the
+   listing may not show a change (e.g. within the same minute); the size and
+   time are read back from the server, so that they match the next scan.
+---------------------------------------------------------------------------*/
+
+func StoreRemote (cache *Cache, conn FTPConn, path, text string) error {
+   full := filepath.Join(Config.RemoteAddr.Path, path)
+   err := conn.Store(full, strings.NewReader(text))
+   if err != nil { return err }
+
+   list, err := conn.ReadDir(filepath.Dir(full))
+   if err != nil { return err }
+   for _, info := range list {
+      if info.Name() != filepath.Base(full) { continue }
+
+      s := NewScanner(cache, conn)
+      ent := cache.AddEntry(path)
+      s.storedCopy(path, text, info, &ent.Remote)
+      if bytes.Equal(ent.Local.Hash, ent.Remote.Hash) {
+         ent.Local.Changed = false
+         ent.Remote.Changed = false
+         if ! s.isBinary(path) { cache.SaveBase(path, ent) }
+      }
+      return nil
+   }
+   return errors.New("Uploaded file not found on server")
+}
+
+/* storedCopy
+**    Updates the fingerprint of a copy that has just been stored with the
+** given text, using the details of the new copy as listed by the server.
+*/
+
+func (s *Scanner) storedCopy (path, text string, info os.FileInfo, fp *FileInfo) {
+   hash := s.newHash(path)
+   io.WriteString(hash, text)
+
+   fp.Changed = true
+   fp.Stale = false
+   fp.ModTime = info.ModTime()
+   fp.Size = info.Size()
+   fp.Tag = remoteMD5(info)
+   fp.Hash = hash.Sum(nil)
+}
@@ -0,0 +1,51 @@
+package app
+
+import (
+   "os"
+   "bytes"
+   "reflect"
+   "testing"
+   "net/url"
+   "crypto/md5"
+   "path/filepath"
+)
+
+func TestHunks (t *testing.T) {
+   local := "a\nb\nc\nd\ne\n"
+   remote := "a\nB\nc\nd\ne\nf\n"
+
+   hunks := Hunks(local, remote)
+   want := []Hunk{
+      { LocalStart: 1, RemoteStart: 1, Local: []string{"b\n"}, Remote: []string{"B\n"} },
+      { LocalStart: 5, RemoteStart: 5, Remote: []string{"f\n"} },
+   }
+   if ! reflect.DeepEqual(hunks, want) { t.Fatalf("got %q, want %q", hunks, want) }
+
+   if got := hunks[0].Push(remote); got != "a\nb\nc\nd\ne\nf\n" { t.Errorf("Push: got %q", got) }
+   if got := hunks[0].Pull(local); got != "a\nB\nc\nd\ne\n" { t.Errorf("Pull: got %q", got) }
+   if got := hunks[1].Pull(local); got != "a\nb\nc\nd\ne\nf\n" { t.Errorf("Pull: got %q", got) }
+
+   if got := Hunks(local, local); len(got) != 0 { t.Errorf("same text: got %q", got) }
+}
+
+func TestStoreRemote (t *testing.T) {
+   remote := tempDir(t)
+   defer os.RemoveAll(remote)
+   writeFiles(t, remote, map[string]string{ "a.txt": "one\n" })
+
+   saved := Config
+   defer func () { Config = saved }()
+   Config = &SiteConfig{ RemoteAddr: &url.URL{ Scheme: "file", Path: filepath.ToSlash(remote) } }
+   conn, err := dialFile(Config.remoteSide())
+   if err != nil { t.Fatal(err) }
+   defer conn.Close()
+
+   // Texts of the same size, stored at once, must each give a new hash
+   cache := NewTransientCache()
+   for _, text := range []string{"two\n", "six\n"} {
+      if err = StoreRemote(cache, conn, "a.txt", text); err != nil { t.Fatal(err) }
+      got := cache.FilePrints["a.txt"].Remote.Hash
+      want := md5.Sum([]byte(text))
+      if ! bytes.Equal(got, want[:]) { t.Errorf("%q: got hash %x, want %x", text, got, want) }
+   }
+}
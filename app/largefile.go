@@ -0,0 +1,191 @@
+package app
+
+/*
+** This file contains the safeguards used by the file viewer for large files.
+** The remote copy is always streamed to a temporary file, showing progress in
+** the status bar, and the transfer may be cancelled. Files beyond the size limit
+** for the site are not loaded into memory or diffed; instead, the viewer shows
+** a summary of the two copies (sizes, hashes and the first differing offset).
+*/
+
+import (
+   "os"
+   "io"
+   "fmt"
+   "bytes"
+   "errors"
+   "io/ioutil"
+   "crypto/md5"
+   "encoding/hex"
+   "path/filepath"
+)
+
+// Default size limit (in MB) for files shown in the viewer
+const DefaultViewLimit = 10
+
+// Size beyond which the viewer only compares line by line, as a character
+// by character comparison takes too long
+const InlineLimit = 1 << 20
+
+var E_Cancelled = errors.New("Cancelled by user")
+
+/*---------------------------------------------------------------------------
+   ViewLimit
+      Returns the size limit, in bytes, for files shown in the viewer.
+---------------------------------------------------------------------------*/
+
+func ViewLimit () int64 {
+   mb := Config.ViewLimit
+   if mb <= 0 { mb = DefaultViewLimit }
+   return int64(mb) << 20
+}
+
+/*---------------------------------------------------------------------------
+   FetchRemoteTemp
+      Streams the remote copy of a file to a temporary file, showing the
+   progress in the status bar. The size, if known, is used to show the
+   percentage done. Returns the name of the temporary file, which the caller
+   must remove, or E_Cancelled if a value is sent on the 'stop' channel.
+      May be called from a goroutine.
+---------------------------------------------------------------------------*/
+
+func FetchRemoteTemp (conn FTPConn, path string, size int64, stop <-chan bool) (string, error) {
+   return fetchTemp(conn, filepath.Join(Config.RemoteAddr.Path, path), size, stop)
+}
+
+/* fetchTemp
+**    Streams a file, given by its full path on the server, to a temporary
+** file as above.
+*/
+
+func fetchTemp (conn FTPConn, full string, size int64, stop <-chan bool) (string, error) {
+   f, err := ioutil.TempFile("", "ftpsync-*" + filepath.Ext(full))
+   if err != nil { return "", err }
+
+   w := &progressWriter{ name: filepath.Base(full), size: size, stop: stop }
+   err = conn.Retrieve(full, io.MultiWriter(f, w))
+
+   if cerr := f.Close(); err == nil { err = cerr }
+   if err != nil {
+      os.Remove(f.Name())
+      if w.cancelled { err = E_Cancelled }
+      return "", err
+   }
+   return f.Name(), nil
+}
+
+/* progressWriter
+**    Counts bytes written and shows the progress in the status bar every so
+** often. Returns an error to abort the transfer when asked to stop.
+*/
+
+type progressWriter struct {
+   name        string
+   size,
+   count,
+   shown       int64
+   stop        <-chan bool
+   cancelled   bool
+}
+
+func (w *progressWriter) Write (p []byte) (int, error) {
+   select {
+      case <- w.stop:
+         w.cancelled = true
+         return 0, E_Cancelled
+      default:
+   }
+
+   w.count += int64(len(p))
+   if w.count - w.shown >= 256 * 1024 {
+      w.shown = w.count
+      msg := fmt.Sprintf("Fetching %s: %.1f MB", w.name, float64(w.count) / (1 << 20))
+      if w.size > 0 {
+         msg += fmt.Sprintf(" of %.1f MB (%d%%)", float64(w.size) / (1 << 20), w.count * 100 / w.size)
+      }
+      qMain.ShowStatus(msg)
+   }
+   return len(p), nil
+}
+
+/*---------------------------------------------------------------------------
+   FileSummary [type]
+      Details of two copies of a file that is too large to show. The offset
+   of the first difference is -1 if the copies are the same.
+---------------------------------------------------------------------------*/
+
+type FileSummary struct {
+   LocalSize,
+   RemoteSize  int64
+   LocalHash,
+   RemoteHash  string
+   Differ      int64
+}
+
+/*---------------------------------------------------------------------------
+   SummariseFiles
+      Reads two files side by side, in blocks, to find their sizes, MD5 hashes
+   (of the raw content) and the offset of the first byte that differs.
+---------------------------------------------------------------------------*/
+
+func SummariseFiles (local, remote string) (*FileSummary, error) {
+   f1, err := os.Open(local)
+   if err != nil { return nil, err }
+   defer f1.Close()
+   f2, err := os.Open(remote)
+   if err != nil { return nil, err }
+   defer f2.Close()
+
+   sum := &FileSummary{ Differ: -1 }
+   h1, h2 := md5.New(), md5.New()
+   b1, b2 := make([]byte, 64 * 1024), make([]byte, 64 * 1024)
+   for {
+      n1, err1 := io.ReadFull(f1, b1)
+      n2, err2 := io.ReadFull(f2, b2)
+      for _, err := range []error{err1, err2} {
+         if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF { return nil, err }
+      }
+
+      if sum.Differ < 0 {
+         n := n1; if n2 < n { n = n2 }
+         for k := 0; k < n; k++ {
+            if b1[k] != b2[k] { sum.Differ = sum.LocalSize + int64(k); break }
+         }
+         if sum.Differ < 0 && n1 != n2 { sum.Differ = sum.LocalSize + int64(n) }
+      }
+
+      h1.Write(b1[:n1]); h2.Write(b2[:n2])
+      sum.LocalSize += int64(n1)
+      sum.RemoteSize += int64(n2)
+      if n1 == 0 && n2 == 0 { break }
+   }
+
+   sum.LocalHash = hex.EncodeToString(h1.Sum(nil))
+   sum.RemoteHash = hex.EncodeToString(h2.Sum(nil))
+   return sum, nil
+}
+
+/*---------------------------------------------------------------------------
+   FileSummary::Html
+      Returns the summary as rich text, for the file viewer.
+---------------------------------------------------------------------------*/
+
+func (s *FileSummary) Html () string {
+   var buf bytes.Buffer
+   fmt.Fprintf(
+      &buf, "<p>This file is too large to compare in the viewer (the limit is %d MB).</p>",
+      ViewLimit() >> 20,
+   )
+   buf.WriteString("<table cellspacing=\"0\" cellpadding=\"4\">")
+   buf.WriteString("<tr><th></th><th align=\"left\">Local</th><th align=\"left\">Remote</th></tr>")
+   fmt.Fprintf(&buf, "<tr><td>Size</td><td>%d bytes</td><td>%d bytes</td></tr>", s.LocalSize, s.RemoteSize)
+   fmt.Fprintf(&buf, "<tr><td>MD5</td><td><tt>%s</tt></td><td><tt>%s</tt></td></tr>", s.LocalHash, s.RemoteHash)
+   buf.WriteString("</table>")
+
+   if s.Differ < 0 {
+      buf.WriteString("<p>The two copies are identical.</p>")
+   } else {
+      fmt.Fprintf(&buf, "<p>The copies first differ at offset %d (0x%x).</p>", s.Differ, s.Differ)
+   }
+   return buf.String()
+}
@@ -0,0 +1,286 @@
+package app
+
+/*
+** This file contains the logic to export the local fingerprints as a signed
+** "manifest" and to check a remote copy against such a manifest. The manifest
+** is a JSON document listing the path, size and hash of each file, together
+** with an ed25519 signature, so it can be used to prove that a deployed site
+** matches an approved release without access to the local source.
+*/
+
+import (
+   "os"
+   "fmt"
+   "bytes"
+   "errors"
+   "time"
+   "strings"
+   "io/ioutil"
+   "path/filepath"
+   "encoding/json"
+   "encoding/hex"
+   "crypto/ed25519"
+   "crypto/rand"
+   "crypto/sha256"
+   "github.com/therecipe/qt/widgets"
+)
+
+/*---------------------------------------------------------------------------
+   Manifest [type]
+      The signed content of a manifest file. Paths always use '/' as the
+   separator, regardless of the platform on which it was created.
+---------------------------------------------------------------------------*/
+
+type Manifest struct {
+   Site        string
+   Created     time.Time
+   Ignore      TextOptions    // options used for text fingerprints
+   Files       []ManifestEntry
+}
+
+type ManifestEntry struct {
+   Path        string
+   IsDir       bool           `json:",omitempty"`
+   Size        int64
+   Hash        []byte         `json:",omitempty"`
+}
+
+// Format of the manifest file on disk. The signature is computed over the
+// compact JSON encoding of the 'Body'.
+type manifestFile struct {
+   Body        json.RawMessage
+   Key,
+   Signature   []byte
+}
+
+/*---------------------------------------------------------------------------
+   ExportManifest
+      Writes the local fingerprints from the given cache to a manifest file,
+   signed with the user's manifest key.
+---------------------------------------------------------------------------*/
+
+func ExportManifest (cache *Cache, path string) error {
+   m := Manifest{
+      Site:    Config.Name,
+      Created: time.Now().UTC(),
+      Ignore:  cache.Ignore,
+      Files:   make([]ManifestEntry, 0, len(cache.FilePrints)),
+   }
+
+   cache.Walk(func (p string, fp *FilePrint) {
+      if p == "." || fp.Local.ModTime.IsZero() { return }
+      if ! fp.Local.IsDir && fp.Local.Hash == nil { return }
+      m.Files = append(m.Files, ManifestEntry{
+         Path:  filepath.ToSlash(p),
+         IsDir: fp.Local.IsDir,
+         Size:  fp.Local.Size,
+         Hash:  fp.Local.Hash,
+      })
+   })
+   if len(m.Files) == 0 {
+      return errors.New("No local fingerprints to export (run a scan first)")
+   }
+
+   key, err := ManifestKey()
+   if err != nil { return err }
+
+   body, err := json.Marshal(&m)
+   if err != nil { return err }
+
+   data, err := json.MarshalIndent(&manifestFile{
+      Body:       body,
+      Key:        key.Public().(ed25519.PublicKey),
+      Signature:  ed25519.Sign(key, body),
+   }, "", "  ")
+   if err != nil { return err }
+
+   return ioutil.WriteFile(path, data, 0644)
+}
+
+/*---------------------------------------------------------------------------
+   LoadManifest
+      Reads a manifest file and checks its signature. If the manifest was not
+   signed by this user, or by a key already trusted for the current site, then
+   the user is asked whether to trust the signing key.
+---------------------------------------------------------------------------*/
+
+func LoadManifest (path string) (*Manifest, error) {
+   data, err := ioutil.ReadFile(path)
+   if err != nil { return nil, err }
+
+   var f manifestFile
+   err = json.Unmarshal(data, &f)
+   if err != nil { return nil, err }
+
+   var body bytes.Buffer
+   err = json.Compact(&body, f.Body)
+   if err != nil { return nil, err }
+
+   if len(f.Key) != ed25519.PublicKeySize ||
+      ! ed25519.Verify(ed25519.PublicKey(f.Key), body.Bytes(), f.Signature) {
+      return nil, errors.New("Manifest signature is not valid")
+   }
+
+   err = vetManifestKey(f.Key)
+   if err != nil { return nil, err }
+
+   m := new(Manifest)
+   err = json.Unmarshal(body.Bytes(), m)
+   if err != nil { return nil, err }
+
+   return m, nil
+}
+
+/*---------------------------------------------------------------------------
+   Manifest::Compare
+      Called after the remote copy has been scanned into the given cache.
+   Fills in the 'local' side of each entry from the manifest and marks the
+   entries that differ.
+---------------------------------------------------------------------------*/
+
+func (m *Manifest) Compare (cache *Cache) {
+   listed := make(map[string]bool)
+
+   for _, f := range m.Files {
+      path := filepath.FromSlash(f.Path)
+      listed[path] = true
+
+      ent := cache.AddEntry(path)
+      ent.Local = FileInfo{
+         IsDir: f.IsDir, Changed: true, ModTime: m.Created, Size: f.Size, Hash: f.Hash,
+      }
+
+      switch {
+         case ent.Remote.ModTime.IsZero():
+            ent.Remote.Changed = true // missing from remote
+         case f.IsDir == ent.Remote.IsDir && (f.IsDir || bytes.Equal(f.Hash, ent.Remote.Hash)):
+            ent.Local.Changed = false
+            ent.Remote.Changed = false
+         default:
+            ent.Remote.Changed = true
+      }
+   }
+
+   // Anything else found on the remote is not part of the release.
+   for path, ent := range cache.FilePrints {
+      if path == "." || listed[path] { continue }
+      ent.Local = FileInfo{ Changed: true }
+      ent.Remote.Changed = true
+   }
+}
+
+/*---------------------------------------------------------------------------
+   VerifyManifest
+      Scans the remote copy for the current site and compares it with the
+   given manifest, in place of the local copy. Runs as a goroutine, in the
+   same way as 'ScanFolders'.
+---------------------------------------------------------------------------*/
+
+func VerifyManifest (m *Manifest, cache *Cache, errors chan<- error, stop <-chan bool) {
+   qMain.ShowStatus("Opening connection ...")
+
+   conn, err := DialRemote()
+   if err == nil {
+      defer conn.Close()
+      s := NewScanner(cache, conn)
+      s.Ignore = m.Ignore
+      err = s.WalkRemote(".", stop)
+      if err == nil { m.Compare(cache) }
+   }
+
+   errors <- err
+   qMain.ScanComplete()
+}
+
+/*---------------------------------------------------------------------------
+   ManifestKey
+      Returns the private key used to sign manifests. The key is created on
+   first use and saved alongside the site list.
+---------------------------------------------------------------------------*/
+
+func ManifestKey () (ed25519.PrivateKey, error) {
+   path, err := os.UserConfigDir()
+   if err != nil { return nil, err }
+   path = filepath.Join(path, "ftpsync", "manifest.key")
+
+   seed, err := ioutil.ReadFile(path)
+   if err == nil {
+      if len(seed) != ed25519.SeedSize {
+         return nil, fmt.Errorf("Bad format for manifest key (%s)", path)
+      }
+      return ed25519.NewKeyFromSeed(seed), nil
+   }
+   if ! os.IsNotExist(err) { return nil, err }
+
+   _, key, err := ed25519.GenerateKey(rand.Reader)
+   if err != nil { return nil, err }
+
+   err = ioutil.WriteFile(path, key.Seed(), 0600)
+   if err != nil { return nil, err }
+
+   return key, nil
+}
+
+/*---------------------------------------------------------------------------
+   KeyFingerprint
+      Returns a printable fingerprint (SHA-256) for a public key.
+---------------------------------------------------------------------------*/
+
+func KeyFingerprint (key []byte) string {
+   sum := sha256.Sum256(key)
+   hx := hex.EncodeToString(sum[:])
+   parts := make([]string, 0, len(hx) / 4)
+   for n := 0; n < len(hx); n += 4 { parts = append(parts, hx[n:n+4]) }
+   return strings.Join(parts, ":")
+}
+
+/*---------------------------------------------------------------------------
+   vetManifestKey
+      Called to vet the key that signed a manifest. Our own key is always
+   trusted, as is any key that the user has accepted before for this site or
+   whose fingerprint is given on the command line. Otherwise, we ask the user
+   if they'll trust this key - except for a check run by a script (with '-o'),
+   where there is no one to ask.
+---------------------------------------------------------------------------*/
+
+func vetManifestKey (key []byte) error {
+   own, err := ManifestKey()
+   if err == nil && bytes.Equal(own.Public().(ed25519.PublicKey), key) { return nil }
+
+   for _, k := range Config.ManifestKeys {
+      if bytes.Equal(k, key) { return nil }
+   }
+   if Opt.TrustKey != "" && sameFingerprint(Opt.TrustKey, KeyFingerprint(key)) { return nil }
+   if Opt.Output != "" {
+      return fmt.Errorf("Manifest key not trusted (fingerprint %s)", KeyFingerprint(key))
+   }
+
+   box := widgets.NewQMessageBox2(
+      widgets.QMessageBox__Warning,
+      "Manifest Key",
+      "The manifest was signed by an unknown key.\n",
+      widgets.QMessageBox__Ok | widgets.QMessageBox__Cancel,
+      nil, 0,
+   )
+   box.SetDetailedText(fmt.Sprintf("Key fingerprint:\n  %s\n", KeyFingerprint(key)))
+   box.SetInformativeText("Do you trust this key?")
+
+   answer := box.Exec()
+   if answer == int(widgets.QMessageBox__Ok) {
+      Config.ManifestKeys = append(Config.ManifestKeys, key)
+      return nil
+   }
+
+   return errors.New("Manifest key not trusted")
+}
+
+/* sameFingerprint
+**    Compares two key fingerprints, ignoring case and any separators.
+*/
+
+func sameFingerprint (fp1, fp2 string) bool {
+   strip := func (fp string) string {
+      return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(fp))
+   }
+   return strip(fp1) == strip(fp2)
+}
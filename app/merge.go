@@ -0,0 +1,238 @@
+package app
+
+/*
+** This file contains the logic for a three-way merge of a file that has been
+** changed on both sides. The 'base' for the merge is the content of the file
+** the last time the local and remote copies were found to match; a copy of each
+** such text file is kept in the user's cache folder, named by its hash, away
+** from the source tree so that the copies are never scanned themselves.
+*/
+
+import (
+   "os"
+   "sort"
+   "bytes"
+   "errors"
+   "strings"
+   "net/url"
+   "io/ioutil"
+   "crypto/md5"
+   "encoding/hex"
+   "path/filepath"
+)
+
+/*---------------------------------------------------------------------------
+   Cache::SaveBase
+      Keeps a copy of the local file as the base for a later merge. Called
+   when the local and remote copies are found to match. Only text files
+   within the viewer size limit are kept, and none for a remote source.
+---------------------------------------------------------------------------*/
+
+func (cache *Cache) SaveBase (path string, fp *FilePrint) {
+   if cache.Transient() || Config.RemoteSource() != nil || fp.Local.IsDir || fp.Local.Size > ViewLimit() { return }
+
+   data, err := ioutil.ReadFile(filepath.Join(Config.Source, path))
+   if err != nil { return }
+   sum := md5.Sum(data)
+   if bytes.Equal(fp.Base, sum[:]) { return }
+
+   dir := cache.baseDir()
+   err = os.MkdirAll(dir, 0700)
+   if err == nil {
+      err = ioutil.WriteFile(filepath.Join(dir, hex.EncodeToString(sum[:])), data, 0600)
+   }
+   if err == nil { fp.Base = sum[:] }
+}
+
+/*---------------------------------------------------------------------------
+   Cache::LoadBase
+      Returns the base copy of a file, as kept when the two copies last
+   matched.
+---------------------------------------------------------------------------*/
+
+func (cache *Cache) LoadBase (fp *FilePrint) (string, error) {
+   if fp.Base == nil || cache.Transient() {
+      return "", errors.New("No base copy was kept for this file")
+   }
+   data, err := ioutil.ReadFile(filepath.Join(cache.baseDir(), hex.EncodeToString(fp.Base)))
+   if err != nil { return "", err }
+   return string(data), nil
+}
+
+/* baseDir
+**    Returns the folder for the base copies of the current site.
+*/
+
+func (cache *Cache) baseDir () string {
+   dir, err := os.UserCacheDir()
+   if err != nil { dir = os.TempDir() }
+   return filepath.Join(dir, "ftpsync", url.QueryEscape(Config.Name) + ".base")
+}
+
+/*---------------------------------------------------------------------------
+   Cache::PruneBases
+      Removes any base copies that are no longer referred to by the cache.
+---------------------------------------------------------------------------*/
+
+func (cache *Cache) PruneBases () {
+   if cache.Transient() { return }
+   dir := cache.baseDir()
+   list, err := ioutil.ReadDir(dir)
+   if err != nil { return }
+
+   keep := make(map[string]bool)
+   for _, fp := range cache.FilePrints {
+      if fp.Base != nil { keep[hex.EncodeToString(fp.Base)] = true }
+   }
+   for _, f := range list {
+      if ! keep[f.Name()] { os.Remove(filepath.Join(dir, f.Name())) }
+   }
+}
+
+/*---------------------------------------------------------------------------
+   MergeChunk [type]
+      Part of the result of a three-way merge: either merged text or, for a
+   conflict, the base, local and remote versions of the lines and the choice
+   made between them.
+---------------------------------------------------------------------------*/
+
+type MergeChunk struct {
+   Text        string
+   Conflict    bool
+   Base,
+   Local,
+   Remote      string
+   Choice      int
+}
+
+const (
+   Choice__None = iota
+   Choice__Local
+   Choice__Remote
+   Choice__Both
+   Choice__Base
+)
+
+// A change from the base, made on one side
+type mergeChange struct {
+   start,
+   end         int
+   lines       []string
+   side        int
+}
+
+/*---------------------------------------------------------------------------
+   Merge3
+      Merges the changes made to the base text in the local and remote
+   copies. Changes to separate parts of the base are both applied. Where
+   both sides changed the same (or adjacent) lines differently, the result
+   has a conflict for the user to resolve.
+---------------------------------------------------------------------------*/
+
+func Merge3 (base, local, remote string) []MergeChunk {
+   baseLines := strings.SplitAfter(base, "\n")
+   if baseLines[len(baseLines) - 1] == "" { baseLines = baseLines[:len(baseLines) - 1] }
+
+   // Collect the changes from each side, in order of position in the base
+   changes := make([]mergeChange, 0)
+   for side, text := range []string{local, remote} {
+      for _, h := range Hunks(base, text) {
+         changes = append(changes, mergeChange{
+            h.LocalStart, h.LocalStart + len(h.Local), h.Remote, side,
+         })
+      }
+   }
+   sort.SliceStable(changes, func (i, j int) bool {
+      a, b := changes[i], changes[j]
+      return a.start < b.start || (a.start == b.start && a.end < b.end)
+   })
+
+   chunks := make([]MergeChunk, 0)
+   pos := 0
+   for n := 0; n < len(changes); {
+      // Group changes that overlap or touch
+      start, end := changes[n].start, changes[n].end
+      k := n + 1
+      for k < len(changes) && changes[k].start <= end {
+         if changes[k].end > end { end = changes[k].end }
+         k++
+      }
+      group := changes[n:k]
+      n = k
+
+      if start > pos { chunks = append(chunks, MergeChunk{ Text: joinLines(baseLines[pos:start]) }) }
+      pos = end
+
+      // Work out each side's version of this part of the base
+      var versions [2]string
+      var changed [2]bool
+      for side := range versions {
+         var buf strings.Builder
+         at := start
+         for _, c := range group {
+            if c.side != side { continue }
+            changed[side] = true
+            buf.WriteString(joinLines(baseLines[at:c.start]))
+            buf.WriteString(joinLines(c.lines))
+            at = c.end
+         }
+         buf.WriteString(joinLines(baseLines[at:end]))
+         versions[side] = buf.String()
+      }
+
+      switch {
+         case ! changed[1] || versions[0] == versions[1]:
+            chunks = append(chunks, MergeChunk{ Text: versions[0] })
+         case ! changed[0]:
+            chunks = append(chunks, MergeChunk{ Text: versions[1] })
+         default:
+            chunks = append(chunks, MergeChunk{
+               Conflict: true,
+               Base:     joinLines(baseLines[start:end]),
+               Local:    versions[0],
+               Remote:   versions[1],
+            })
+      }
+   }
+   if pos < len(baseLines) { chunks = append(chunks, MergeChunk{ Text: joinLines(baseLines[pos:]) }) }
+
+   return chunks
+}
+
+func joinLines (lines []string) string {
+   return strings.Join(lines, "")
+}
+
+/*---------------------------------------------------------------------------
+   MergeText
+      Returns the text that results from a merge. Any conflict that has not
+   been resolved is shown with the usual markers. Also returns the number of
+   such conflicts.
+---------------------------------------------------------------------------*/
+
+func MergeText (chunks []MergeChunk) (string, int) {
+   var buf strings.Builder
+   open := 0
+   for _, c := range chunks {
+      if ! c.Conflict { buf.WriteString(c.Text); continue }
+      switch c.Choice {
+         case Choice__Local: buf.WriteString(c.Local)
+         case Choice__Remote: buf.WriteString(c.Remote)
+         case Choice__Both: buf.WriteString(c.Local); buf.WriteString(c.Remote)
+         case Choice__Base: buf.WriteString(c.Base)
+         default:
+            open++
+            buf.WriteString("<<<<<<< local\n")
+            buf.WriteString(withNewline(c.Local))
+            buf.WriteString("=======\n")
+            buf.WriteString(withNewline(c.Remote))
+            buf.WriteString(">>>>>>> remote\n")
+      }
+   }
+   return buf.String(), open
+}
+
+func withNewline (text string) string {
+   if text != "" && ! strings.HasSuffix(text, "\n") { text += "\n" }
+   return text
+}
@@ -0,0 +1,48 @@
+package app
+
+import (
+   "testing"
+)
+
+func TestMerge3 (t *testing.T) {
+   base := "one\ntwo\nthree\nfour\nfive\n"
+   tests := []struct {
+      local,
+      remote,
+      want        string
+      conflicts   int
+   }{
+      // Changes on one side only
+      { base, base, base, 0 },
+      { "one\nTWO\nthree\nfour\nfive\n", base, "one\nTWO\nthree\nfour\nfive\n", 0 },
+      { base, "one\ntwo\nthree\nfour\n", "one\ntwo\nthree\nfour\n", 0 },
+      // Changes to separate parts are both applied
+      { "ONE\ntwo\nthree\nfour\nfive\n", "one\ntwo\nthree\nfour\nFIVE\n", "ONE\ntwo\nthree\nfour\nFIVE\n", 0 },
+      // The same change on both sides is not a conflict
+      { "one\ntwo\n3\nfour\nfive\n", "one\ntwo\n3\nfour\nfive\n", "one\ntwo\n3\nfour\nfive\n", 0 },
+      // Different changes to the same line are
+      { "one\ntwo\nL\nfour\nfive\n", "one\ntwo\nR\nfour\nfive\n",
+         "one\ntwo\n<<<<<<< local\nL\n=======\nR\n>>>>>>> remote\nfour\nfive\n", 1 },
+   }
+   for n, test := range tests {
+      got, open := MergeText(Merge3(base, test.local, test.remote))
+      if got != test.want || open != test.conflicts {
+         t.Errorf("%d: got %q (%d conflicts), want %q (%d)", n, got, open, test.want, test.conflicts)
+      }
+   }
+}
+
+func TestMergeChoice (t *testing.T) {
+   chunks := Merge3("a\nb\nc\n", "a\nL\nc\n", "a\nR\nc\n")
+   for choice, want := range map[int]string{
+      Choice__Local:  "a\nL\nc\n",
+      Choice__Remote: "a\nR\nc\n",
+      Choice__Both:   "a\nL\nR\nc\n",
+      Choice__Base:   "a\nb\nc\n",
+   } {
+      for n := range chunks { chunks[n].Choice = choice }
+      if got, open := MergeText(chunks); got != want || open != 0 {
+         t.Errorf("choice %d: got %q (%d conflicts), want %q", choice, got, open, want)
+      }
+   }
+}
@@ -0,0 +1,209 @@
+package app
+
+/*
+** This file contains the merge editor, used from the file viewer to resolve a
+** conflict (a file changed on both sides) by merging the local and remote copies
+** against the base copy kept from the last time they matched.
+*/
+
+import (
+   "fmt"
+   "path/filepath"
+   "github.com/therecipe/qt/widgets"
+   "github.com/therecipe/qt/gui"
+)
+
+/*---------------------------------------------------------------------------
+   MergeEditor [type]
+      Popup window that shows the result of a three-way merge and allows the
+   user to choose how to resolve each conflicting block.
+---------------------------------------------------------------------------*/
+
+type MergeEditor struct {
+   widgets.QDialog
+
+   info        *widgets.QLabel
+   list        *widgets.QListWidget
+   views       [3]*widgets.QTextEdit
+   result      *widgets.QTextEdit
+   upload      *widgets.QCheckBox
+
+   file        string
+   chunks      []MergeChunk
+   conflicts   []int          // index in 'chunks' of each conflict
+   Merged      string         // result, once saved
+
+   _ func() `constructor:"init"`
+}
+
+// Names for each choice, as shown in the list of conflicts
+var choiceNames = []string{"unresolved", "local", "remote", "local then remote", "base"}
+
+/* init
+**    Creates the child widgets.
+*/
+
+func (d *MergeEditor) init () {
+   layout := widgets.NewQVBoxLayout2(d)
+
+   d.info = widgets.NewQLabel(nil, 0)
+   layout.AddWidget(d.info, 0, 0)
+
+   split := widgets.NewQSplitter(nil)
+   layout.AddWidget(split, 1, 0)
+
+   d.list = widgets.NewQListWidget(nil)
+   split.AddWidget(d.list)
+
+   pane := widgets.NewQWidget(nil, 0)
+   grid := widgets.NewQGridLayout(pane)
+   grid.SetContentsMargins(0, 0, 0, 0)
+   for n, label := range []string{"Base", "Local", "Remote"} {
+      grid.AddWidget2(widgets.NewQLabel2(label, nil, 0), 0, n, 0)
+      d.views[n] = widgets.NewQTextEdit(nil)
+      d.views[n].SetReadOnly(true)
+      d.views[n].SetLineWrapMode(widgets.QTextEdit__NoWrap)
+      d.views[n].SetFont(gui.QFontDatabase_SystemFont(gui.QFontDatabase__FixedFont))
+      grid.AddWidget2(d.views[n], 1, n, 0)
+   }
+
+   row := widgets.NewQHBoxLayout()
+   for _, c := range []int{Choice__Local, Choice__Remote, Choice__Both, Choice__Base} {
+      choice := c
+      bn := widgets.NewQPushButton2("Use " + choiceNames[c], nil)
+      bn.ConnectClicked(func (bool) { d.choose(choice) })
+      row.AddWidget(bn, 0, 0)
+   }
+   row.AddStretch(1)
+   grid.AddLayout2(row, 2, 0, 1, 3, 0)
+   split.AddWidget(pane)
+   split.SetStretchFactor(1, 1)
+
+   layout.AddWidget(widgets.NewQLabel2("Result:", nil, 0), 0, 0)
+   d.result = widgets.NewQTextEdit(nil)
+   d.result.SetReadOnly(true)
+   d.result.SetLineWrapMode(widgets.QTextEdit__NoWrap)
+   d.result.SetFont(gui.QFontDatabase_SystemFont(gui.QFontDatabase__FixedFont))
+   layout.AddWidget(d.result, 1, 0)
+
+   d.upload = widgets.NewQCheckBox2("Also upload the result to the remote copy", nil)
+   layout.AddWidget(d.upload, 0, 0)
+
+   buttons := widgets.NewQDialogButtonBox3(
+      widgets.QDialogButtonBox__Save | widgets.QDialogButtonBox__Cancel,
+      nil,
+   )
+   layout.AddWidget(buttons, 0, 0)
+
+   d.list.ConnectCurrentRowChanged(d.showConflict)
+   buttons.ConnectAccepted(d.save)
+   buttons.ConnectRejected(d.Reject)
+   d.Resize2(900, 700)
+}
+
+/* SetFiles
+**    Merges the local and remote copies of a file against its base, and
+** shows the result.
+*/
+
+func (d *MergeEditor) SetFiles (path, base, local, remote string) {
+   d.file = path
+   d.SetWindowTitle("Merge " + filepath.Base(path) + " - " + gui.QGuiApplication_ApplicationDisplayName())
+   d.chunks = Merge3(base, local, remote)
+
+   d.conflicts = nil
+   d.list.Clear()
+   for n, c := range d.chunks {
+      if ! c.Conflict { continue }
+      d.conflicts = append(d.conflicts, n)
+      d.list.AddItem("")
+   }
+   d.update()
+   if len(d.conflicts) > 0 { d.list.SetCurrentRow(0) } else { d.showConflict(-1) }
+}
+
+/* showConflict
+**    Shows the three versions of the selected conflict.
+*/
+
+func (d *MergeEditor) showConflict (row int) {
+   if row < 0 || row >= len(d.conflicts) {
+      for _, v := range d.views { v.Clear() }
+      return
+   }
+   c := &d.chunks[d.conflicts[row]]
+   for n, text := range []string{c.Base, c.Local, c.Remote} {
+      d.views[n].SetPlainText(text)
+   }
+}
+
+/* choose
+**    Handles the 'use ...' buttons, to resolve the selected conflict.
+*/
+
+func (d *MergeEditor) choose (choice int) {
+   row := d.list.CurrentRow()
+   if row < 0 || row >= len(d.conflicts) { return }
+   d.chunks[d.conflicts[row]].Choice = choice
+   d.update()
+   if row + 1 < len(d.conflicts) { d.list.SetCurrentRow(row + 1) }
+}
+
+/* update
+**    Refreshes the list of conflicts and the merged result.
+*/
+
+func (d *MergeEditor) update () {
+   for n, k := range d.conflicts {
+      d.list.Item(n).SetText(fmt.Sprintf("Conflict %d: %s", n + 1, choiceNames[d.chunks[k].Choice]))
+   }
+
+   text, open := MergeText(d.chunks)
+   d.result.SetPlainText(text)
+   switch {
+      case len(d.conflicts) == 0:
+         d.info.SetText("All changes were merged without conflicts.")
+      case open == 0:
+         d.info.SetText(fmt.Sprintf("All %d conflicts resolved.", len(d.conflicts)))
+      default:
+         d.info.SetText(fmt.Sprintf("%d of %d conflicts to resolve.", open, len(d.conflicts)))
+   }
+}
+
+/* save
+**    Handles the 'save' button. Writes the result to the local copy and (if
+** chosen) uploads it, then updates the fingerprint and the report.
+*/
+
+func (d *MergeEditor) save () {
+   text, open := MergeText(d.chunks)
+   if open > 0 {
+      widgets.QMessageBox_Warning(
+         d, "Merge", "Please resolve every conflict before saving.",
+         widgets.QMessageBox__Ok, widgets.QMessageBox__NoButton,
+      )
+      return
+   }
+
+   cache := qMain.cache
+   src, err := qMain.sourceConnection()
+   if err == nil { err = StoreLocal(cache, src, d.file, text) }
+   if err == nil && d.upload.IsChecked() {
+      var conn FTPConn
+      conn, err = qMain.viewConnection()
+      if err == nil { err = StoreRemote(cache, conn, d.file, text) }
+      if err != nil { qMain.closeView() }
+   }
+   if err != nil {
+      widgets.QMessageBox_Critical(
+         d, "Error", fmt.Sprintf("Save merge: %v", err),
+         widgets.QMessageBox__Ok, widgets.QMessageBox__NoButton,
+      )
+      return
+   }
+
+   cache.Write()
+   qMain.report.SetModel(ShowResults(cache))
+   d.Merged = text
+   d.Accept()
+}
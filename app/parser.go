@@ -13,15 +13,38 @@ package app
 **
 **    -verbose             Logs activity to standard "error" stream. Mainly
 **                         useful for debugging.
+**
+**    -verify <manifest>   Checks the remote copy for the site against a
+**                         signed manifest, instead of the local copy.
+**
+**    -o <file>            Runs a scan (or the 'verify' check) on startup,
+**                         saves the results to the given file and quits.
+**
+**    -report-format <fmt> Format for the above: 'json', 'csv', 'junit' or
+**                         'html'.
+**                         The default is chosen from the file extension.
+**
+**    -bandwidth <KB/s>    Limits the rate of transfers to and from the remote
+**                         copy, overriding the limit set for the site. Zero
+**                         removes the limit.
+**
+**    -trust-key <fp>      Trusts the manifest key with the given fingerprint
+**                         for the 'verify' check, without asking.
 */
 
 import (
    "log"
+   "strconv"
    "github.com/therecipe/qt/core"
 )
 
 var Opt struct {
    Verbose     bool
+   Verify      string
+   Output,
+   ReportFormat string
+   Bandwidth   int            // KB/s; -1 if not set
+   TrustKey    string         // fingerprint of a manifest key
 }
 
 /*---------------------------------------------------------------------------
@@ -35,15 +58,52 @@ func ParseOptions () {
    verbose := core.NewQCommandLineOption3(
       "verbose", "Logs activity to standard error stream.", "", "",
    )
+   verify := core.NewQCommandLineOption3(
+      "verify", "Checks the remote site against a signed manifest.", "manifest", "",
+   )
+   output := core.NewQCommandLineOption4(
+      []string{"o", "output"}, "Scans, saves the results to a report file and quits.", "file", "",
+   )
+   format := core.NewQCommandLineOption3(
+      "report-format", "Report file format (json, csv, junit or html).", "format", "",
+   )
+   bandwidth := core.NewQCommandLineOption3(
+      "bandwidth", "Limits the transfer rate (0 for no limit).", "KB/s", "",
+   )
+   trustKey := core.NewQCommandLineOption3(
+      "trust-key", "Trusts the manifest key with this fingerprint.", "fingerprint", "",
+   )
    
    parser.SetApplicationDescription(
       "Compares a local folder and contents with a remote copy, accessed via FTP.")
    parser.AddHelpOption()
    parser.AddOption(verbose)
+   parser.AddOption(verify)
+   parser.AddOption(output)
+   parser.AddOption(format)
+   parser.AddOption(bandwidth)
+   parser.AddOption(trustKey)
    parser.AddPositionalArgument("site", "Site to load as initial default", "name")
    parser.Process(core.QCoreApplication_Arguments())
    
    Opt.Verbose = parser.IsSet2(verbose)
+   Opt.Verify = parser.Value2(verify)
+   Opt.Output = parser.Value2(output)
+   Opt.ReportFormat = parser.Value2(format)
+   Opt.TrustKey = parser.Value2(trustKey)
+   
+   if Opt.ReportFormat != "" {
+      ok := false
+      for _, f := range ReportFormats { ok = ok || f == Opt.ReportFormat }
+      if ! ok { log.Fatalf("Unsupported report format: %s", Opt.ReportFormat) }
+   }
+   
+   Opt.Bandwidth = -1
+   if parser.IsSet2(bandwidth) {
+      n, err := strconv.Atoi(parser.Value2(bandwidth))
+      if err != nil || n < 0 { log.Fatalf("Invalid bandwidth limit: %s", parser.Value2(bandwidth)) }
+      Opt.Bandwidth = n
+   }
    
    args := parser.PositionalArguments()
    if len(args) > 0 {
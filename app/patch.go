@@ -0,0 +1,197 @@
+package app
+
+/*
+** This file contains the logic to save the differences between local and remote
+** copies as a standard 'unified diff' (patch), with the local copy as 'a/' and
+** the remote copy as 'b/'. Applying the patch to the local folder (e.g. with
+** 'git apply') brings it into line with the remote copy.
+*/
+
+import (
+   "io"
+   "fmt"
+   "strings"
+   "path/filepath"
+   dmp "github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// Number of unchanged lines shown either side of a change
+const PatchContext = 3
+
+// A single line of a patch, with its prefix (' ', '-' or '+')
+type patchLine struct {
+   op          byte
+   text        string
+}
+
+/*---------------------------------------------------------------------------
+   UnifiedDiff
+      Returns the differences between the local and remote copies of a file
+   as a unified diff, or a blank string if they are the same. If either copy
+   is missing, the patch creates or deletes the file.
+---------------------------------------------------------------------------*/
+
+func UnifiedDiff (path, local, remote string, haveLocal, haveRemote bool) string {
+   if haveLocal && haveRemote && local == remote { return "" }
+
+   name := filepath.ToSlash(path)
+   var buf strings.Builder
+   fmt.Fprintf(&buf, "diff --git a/%s b/%s\n", name, name)
+   switch {
+      case ! haveLocal:
+         fmt.Fprintf(&buf, "new file mode 100644\n--- /dev/null\n+++ b/%s\n", name)
+      case ! haveRemote:
+         fmt.Fprintf(&buf, "deleted file mode 100644\n--- a/%s\n+++ /dev/null\n", name)
+      default:
+         fmt.Fprintf(&buf, "--- a/%s\n+++ b/%s\n", name, name)
+   }
+
+   lines := patchLines(local, remote)
+   for _, h := range patchHunks(lines) { writeHunk(&buf, lines, h[0], h[1]) }
+   return buf.String()
+}
+
+/* patchLines
+**    Converts the line-based diff of two texts to a list of patch lines.
+*/
+
+func patchLines (local, remote string) []patchLine {
+   lines := make([]patchLine, 0)
+   for _, d := range LineDiff(local, remote) {
+      op := byte(' ')
+      switch d.Type {
+         case dmp.DiffDelete: op = '-'
+         case dmp.DiffInsert: op = '+'
+      }
+      for _, l := range strings.SplitAfter(d.Text, "\n") {
+         if l != "" { lines = append(lines, patchLine{op, l}) }
+      }
+   }
+   return lines
+}
+
+/* patchHunks
+**    Groups the changes into hunks, with context lines either side, and
+** returns the range of patch lines for each. Two changes are in the same
+** hunk if their context would overlap.
+*/
+
+func patchHunks (lines []patchLine) [][2]int {
+   hunks := make([][2]int, 0)
+   for start := 0; start < len(lines); {
+      for start < len(lines) && lines[start].op == ' ' { start++ }
+      if start == len(lines) { break }
+
+      end := start
+      for n := start; n < len(lines) && n - end <= 2 * PatchContext; n++ {
+         if lines[n].op != ' ' { end = n }
+      }
+
+      from := start - PatchContext; if from < 0 { from = 0 }
+      to := end + PatchContext + 1; if to > len(lines) { to = len(lines) }
+      hunks = append(hunks, [2]int{from, to})
+      start = to
+   }
+   return hunks
+}
+
+/* writeHunk
+**    Writes a single hunk, covering the given range of patch lines, with its
+** header giving the line numbers in each copy.
+*/
+
+func writeHunk (w io.Writer, lines []patchLine, from, to int) {
+   fmt.Fprintf(w, "%s\n", hunkHeader(lines, from, to))
+   for _, l := range lines[from:to] {
+      fmt.Fprintf(w, "%c%s", l.op, l.text)
+      if ! strings.HasSuffix(l.text, "\n") { fmt.Fprintf(w, "\n\\ No newline at end of file\n") }
+   }
+}
+
+/* hunkHeader
+**    Returns the header for a hunk, giving the line numbers in each copy.
+*/
+
+func hunkHeader (lines []patchLine, from, to int) string {
+   aStart, bStart := 1, 1
+   for _, l := range lines[:from] {
+      if l.op != '+' { aStart++ }
+      if l.op != '-' { bStart++ }
+   }
+
+   aCount, bCount := 0, 0
+   for _, l := range lines[from:to] {
+      if l.op != '+' { aCount++ }
+      if l.op != '-' { bCount++ }
+   }
+   if aCount == 0 { aStart-- }
+   if bCount == 0 { bStart-- }
+
+   return fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aCount, bStart, bCount)
+}
+
+/*---------------------------------------------------------------------------
+   SavePatch
+      Writes a single patch file covering every changed text file in the
+   given cache, or just those within a folder (if not blank). Binary files are
+   left out, as are files beyond the view size
+   limit, which are noted in their place (as text that 'git apply' ignores). The
+   file is only written if the patch is complete: it stops early, with
+   'E_Cancelled', if a value is sent on the 'stop' channel.
+---------------------------------------------------------------------------*/
+
+func SavePatch (cache *Cache, folder, path string, stop <-chan bool) error {
+   conn, err := DialRemote()
+   if err != nil { return err }
+   defer conn.Close()
+   src, err := openSource()
+   if err != nil { return err }
+   if src != nil { defer src.Close() }
+
+   return saveFile(path, func (f io.Writer) error {
+      return writePatch(cache, folder, conn, src, f, stop)
+   })
+}
+
+/* writePatch
+**    Writes the patch for 'SavePatch', using open connections.
+*/
+
+func writePatch (cache *Cache, folder string, conn, src FTPConn, f io.Writer, stop <-chan bool) error {
+   s := NewScanner(cache, conn)
+   var fail error
+   cache.Walk(func (rel string, fp *FilePrint) {
+      if fail != nil || rel == "." { return }
+      if folder != "" && ! strings.HasPrefix(rel, folder + string(filepath.Separator)) { return }
+      if ! (fp.Local.Changed || fp.Remote.Changed) { return }
+      if fp.Local.IsDir || fp.Remote.IsDir || s.isBinary(rel) { return }
+      if fp.Local.Size > ViewLimit() || fp.Remote.Size > ViewLimit() {
+         _, fail = fmt.Fprintf(f, "Not compared (too large): %s\n", filepath.ToSlash(rel))
+         return
+      }
+      select {
+         case _ = <-stop:
+            fail = E_Cancelled
+            return
+         default:
+            // continue
+      }
+      qMain.ShowStatus(rel)
+
+      ls, rs := Classify(fp)
+      var local, remote string
+      if ls != State__Missing {
+         local, fail = FetchLocal(src, rel)
+         if fail != nil { return }
+      }
+      if rs != State__Missing {
+         remote, fail = FetchRemote(conn, rel)
+         if fail != nil { return }
+      }
+
+      _, fail = io.WriteString(
+         f, UnifiedDiff(rel, local, remote, ls != State__Missing, rs != State__Missing),
+      )
+   })
+   return fail
+}
@@ -0,0 +1,45 @@
+package app
+
+import (
+   "testing"
+)
+
+func TestUnifiedDiff (t *testing.T) {
+   tests := []struct {
+      local,
+      remote      string
+      haveLocal,
+      haveRemote  bool
+      want        string
+   }{
+      { "a\n", "a\n", true, true, "" },
+      { "a\nb\nc\n", "a\nB\nc\n", true, true,
+         "diff --git a/dir/f.txt b/dir/f.txt\n--- a/dir/f.txt\n+++ b/dir/f.txt\n" +
+         "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n" },
+      { "", "new\n", false, true,
+         "diff --git a/dir/f.txt b/dir/f.txt\nnew file mode 100644\n--- /dev/null\n+++ b/dir/f.txt\n" +
+         "@@ -0,0 +1,1 @@\n+new\n" },
+      { "old\n", "", true, false,
+         "diff --git a/dir/f.txt b/dir/f.txt\ndeleted file mode 100644\n--- a/dir/f.txt\n+++ /dev/null\n" +
+         "@@ -1,1 +0,0 @@\n-old\n" },
+      { "a\n", "a\nb", true, true,
+         "diff --git a/dir/f.txt b/dir/f.txt\n--- a/dir/f.txt\n+++ b/dir/f.txt\n" +
+         "@@ -1,1 +1,2 @@\n a\n+b\n\\ No newline at end of file\n" },
+   }
+   for n, test := range tests {
+      got := UnifiedDiff("dir/f.txt", test.local, test.remote, test.haveLocal, test.haveRemote)
+      if got != test.want { t.Errorf("%d: got\n%s\nwant\n%s", n, got, test.want) }
+   }
+}
+
+func TestUnifiedDiffHunks (t *testing.T) {
+   // Changes far enough apart are given separate hunks, with context
+   local := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+   remote := "one\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\ntwelve\n"
+   want := "diff --git a/f b/f\n--- a/f\n+++ b/f\n" +
+      "@@ -1,4 +1,4 @@\n-1\n+one\n 2\n 3\n 4\n" +
+      "@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+twelve\n"
+   if got := UnifiedDiff("f", local, remote, true, true); got != want {
+      t.Errorf("got\n%s\nwant\n%s", got, want)
+   }
+}
@@ -0,0 +1,179 @@
+package app
+
+/*
+** This file contains the support for a site whose source is another remote
+** copy, rather than a local folder: for example, to compare a staging server
+** with production. The source is given as a URL, in the same form as the remote
+** address (e.g. 'sftp://user@staging.example.com/var/www'), and is accessed
+** through the same interface. The connection options under 'Advanced' apply to
+** both sides; only the address, password and trusted keys are kept apart.
+*/
+
+import (
+   "os"
+   "fmt"
+   "bytes"
+   "errors"
+   "strings"
+   "net/url"
+   "path/filepath"
+)
+
+/*---------------------------------------------------------------------------
+   SiteConfig::RemoteSource
+      Returns the address of the source, if it is a remote copy, else nil.
+---------------------------------------------------------------------------*/
+
+func (c *SiteConfig) RemoteSource () *url.URL {
+   addr, _ := c.sourceAddr()
+   return addr
+}
+
+/* sourceAddr
+**    Parses the source as a URL, if it has the form of one. Returns nil for
+** a local folder.
+*/
+
+func (c *SiteConfig) sourceAddr () (*url.URL, error) {
+   if ! strings.Contains(c.Source, "://") { return nil, nil }
+   addr, err := url.Parse(c.Source)
+   if err != nil { return nil, fmt.Errorf("Source address: %v", err) }
+   return addr, nil
+}
+
+/* CheckSource
+**    Checks the source address, if the source is a remote copy.
+*/
+
+func (c *SiteConfig) CheckSource () error {
+   addr, err := c.sourceAddr()
+   if addr == nil { return err }
+
+   known := false
+   for _, s := range Schemes { known = known || s == addr.Scheme }
+   switch {
+      case ! known:
+         return fmt.Errorf("Unsupported scheme (%s) for source address", addr.Scheme)
+      case addr.Scheme == "file" && addr.Path == "":
+         return errors.New("No source folder configured for scan")
+      case addr.Scheme != "file" && addr.Host == "":
+         return errors.New("No source server configured for scan")
+   }
+   return nil
+}
+
+/*---------------------------------------------------------------------------
+   DialSource
+      Opens a connection to the remote source for the current site, in the
+   same way as 'DialRemote'.
+---------------------------------------------------------------------------*/
+
+func DialSource () (FTPConn, error) {
+   r := Config.sourceSide()
+   if r == nil { return nil, errors.New("The source is not a remote copy") }
+   return dialSide(r)
+}
+
+/* sourceSide
+**    Returns the remote source of the site, as a side to connect to, or nil
+** for a local folder. A server time zone detected for the source is only
+** kept for the connection, as the saved offset is that of the remote copy.
+*/
+
+func (c *SiteConfig) sourceSide () *RemoteSide {
+   addr := c.RemoteSource()
+   if addr == nil { return nil }
+   offset := c.FTP.TimeOffset
+   return &RemoteSide{
+      Site:          c,
+      Addr:          addr,
+      password:      &c.sourcePassword,
+      hostKey:       &c.SourceKey,
+      pins:          &c.SourcePins,
+      expiryWarned:  &c.sourceWarned,
+      timeOffset:    &offset,
+   }
+}
+
+/* sourceName
+**    Returns the source for the current site, without the password (if any).
+*/
+
+func sourceName () string {
+   addr := Config.RemoteSource()
+   if addr == nil { return Config.Source }
+   u := *addr
+   if u.User != nil { u.User = url.User(u.User.Username()) }
+   return strings.TrimSuffix(u.String(), "/")
+}
+
+/* openSource
+**    Opens a connection to the source, if it is a remote copy. Returns nil
+** for a local folder.
+*/
+
+func openSource () (FTPConn, error) {
+   if Config.RemoteSource() == nil { return nil, nil }
+   return DialSource()
+}
+
+/*---------------------------------------------------------------------------
+   FetchSourceTemp
+      Streams the source copy of a file to a temporary file, in the same
+   way as 'FetchRemoteTemp', using an open connection to the source.
+---------------------------------------------------------------------------*/
+
+func FetchSourceTemp (src FTPConn, path string, stop <-chan bool) (string, error) {
+   return fetchTemp(src, filepath.Join(Config.RemoteSource().Path, path), 0, stop)
+}
+
+/* fetchSource
+**    Returns the text of the source copy of a file, using an open connection
+** to the source.
+*/
+
+func fetchSource (src FTPConn, path string) (string, error) {
+   var buf strings.Builder
+   err := src.Retrieve(filepath.Join(Config.RemoteSource().Path, path), &buf)
+   return buf.String(), err
+}
+
+/*---------------------------------------------------------------------------
+   storeSource
+      Uploads new text for the source copy of a file and updates its
+   fingerprint in the given cache, as 'StoreRemote' does for the remote copy.
+---------------------------------------------------------------------------*/
+
+func storeSource (cache *Cache, src FTPConn, path, text string) error {
+   full := filepath.Join(Config.RemoteSource().Path, path)
+   err := src.Store(full, strings.NewReader(text))
+   if err != nil { return err }
+
+   list, err := src.ReadDir(filepath.Dir(full))
+   if err != nil { return err }
+   for _, info := range list {
+      if info.Name() != filepath.Base(full) { continue }
+      s := NewScanner(cache, nil)
+      ent := cache.AddEntry(path)
+      s.storedCopy(path, text, info, &ent.Local)
+      if bytes.Equal(ent.Local.Hash, ent.Remote.Hash) {
+         ent.Local.Changed = false
+         ent.Remote.Changed = false
+      }
+      return nil
+   }
+   return errors.New("Uploaded file not found on source server")
+}
+
+/*---------------------------------------------------------------------------
+   sourceCachePath
+      Returns the location for a cache file given without a folder, for a
+   site with a remote source. This is kept with the saved config, named for
+   the site.
+---------------------------------------------------------------------------*/
+
+func sourceCachePath (name string) string {
+   dir, err := os.UserConfigDir()
+   if err != nil { dir = os.TempDir() }
+   return filepath.Join(dir, "ftpsync", url.QueryEscape(Config.Name) + name)
+}
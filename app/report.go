@@ -6,6 +6,13 @@ package app
 */
 
 import (
+   "fmt"
+   "bytes"
+   "regexp"
+   "path/filepath"
+   "strings"
+   "strconv"
+   "encoding/hex"
    "github.com/therecipe/qt/widgets"
    "github.com/therecipe/qt/core"
    "github.com/therecipe/qt/gui"
@@ -13,6 +20,27 @@ import (
 
 var ReportIcons map[string]*gui.QIcon
 
+// Column headings for the report. Those after the first three are optional
+// and are only shown if selected for the current site.
+var ResultColumns = []string{
+   "Path", "Local", "Remote",
+   "Local Size", "Remote Size", "Local Modified", "Remote Modified",
+   "Local Hash", "Remote Hash", "Reason",
+}
+
+const FixedColumns = 3
+
+// Custom data roles for the report model. The 'sort' role holds a value for
+// ordering a column; the 'category' and 'path' roles (path column only) hold
+// the name of the filter category for the row and the full relative path.
+const (
+   SortRole = int(core.Qt__UserRole) + iota
+   CategoryRole
+   PathRole
+)
+
+var Categories = []string{"upload", "download", "conflict", "missing"}
+
 /*---------------------------------------------------------------------------
    init
       Module initialisation. Creates the icon cache.
@@ -23,42 +51,273 @@ func init () {
 }
 
 /*---------------------------------------------------------------------------
-   ShowResults
-      Builds up a report as a Qt table model.
+   File states
+      Classification of the local or remote copy of a file, relative to the
+   last time both copies were known to be the same.
 ---------------------------------------------------------------------------*/
 
-func ShowResults (cache *Cache) (model *ResultsModel) {
-   model = NewResultsModel(nil)
-   
+const (
+   State__Unchanged = iota
+   State__Changed
+   State__Conflict
+   State__Missing
+)
+
+var StateNames = []string{"unchanged", "changed", "conflict", "missing"}
+
+/*---------------------------------------------------------------------------
+   Classify
+      Returns the state of the local and remote copies for a given cache
+   entry. Both are 'unchanged' if the entry need not be reported.
+---------------------------------------------------------------------------*/
+
+func Classify (fp *FilePrint) (local, remote int) {
+   switch {
+      case fp.Local.Changed && fp.Remote.Changed: {
+         switch {
+            case fp.Remote.ModTime.IsZero(): return State__Changed, State__Missing
+            case fp.Local.ModTime.IsZero(): return State__Missing, State__Changed
+            default: return State__Conflict, State__Conflict
+         }
+      }
+      case fp.Local.Changed: {
+         return State__Changed, State__Unchanged
+      }
+      case fp.Remote.Changed: {
+         return State__Unchanged, State__Changed
+      }
+   }
+   return State__Unchanged, State__Unchanged
+}
+
+/*---------------------------------------------------------------------------
+   Reason
+      Returns a short description of why a cache entry is reported as
+   different, or a blank string if it is not.
+---------------------------------------------------------------------------*/
+
+func Reason (fp *FilePrint) string {
+   switch {
+      case ! (fp.Local.Changed || fp.Remote.Changed):
+         return ""
+      case fp.Local.Changed && fp.Remote.Changed && fp.Local.ModTime.IsZero():
+         return "Missing local"
+      case fp.Local.Changed && fp.Remote.Changed && fp.Remote.ModTime.IsZero():
+         return "Missing remote"
+      case fp.Local.IsDir || fp.Remote.IsDir:
+         return "Folder"
+      case fp.Local.Hash == nil || fp.Remote.Hash == nil:
+         return "Hash unavailable"
+      case bytes.Equal(fp.Local.Hash, fp.Remote.Hash):
+         if fp.Local.Size != fp.Remote.Size { return "Size-only change" }
+         return "Timestamp-only change"
+   }
+   return "Content differs"
+}
+
+/*---------------------------------------------------------------------------
+   Category
+      Returns the filter category (see 'Categories') for a reported file,
+   given the local and remote states.
+---------------------------------------------------------------------------*/
+
+func Category (local, remote int) string {
+   switch {
+      case local == State__Missing || remote == State__Missing: return "missing"
+      case local == State__Conflict: return "conflict"
+      case local == State__Changed: return "upload"
+   }
+   return "download"
+}
+
+/*---------------------------------------------------------------------------
+   LoadReportIcons
+      Loads the icons used in the report (once only).
+---------------------------------------------------------------------------*/
+
+func LoadReportIcons () {
    if len(ReportIcons) == 0 {
       for _, ic := range []string{"upload", "download", "conflict"} {
          ReportIcons[ic] = gui.NewQIcon5(":/images/" + ic + ".png")
       }
    }
+}
+
+/*---------------------------------------------------------------------------
+   ShowResults
+      Builds up a report as a Qt table model. If the current site uses the
+   tree view, the model is hierarchical (see 'showTree').
+---------------------------------------------------------------------------*/
+
+func ShowResults (cache *Cache) (model *ResultsModel) {
+   LoadReportIcons()
+   if Config.TreeView { return showTree(cache) }
+   
+   model = NewResultsModel(nil)
+   cache.Walk(func (path string, fp *FilePrint) {
+      if path == "." { return }
+      if ! (fp.Local.Changed || fp.Remote.Changed) { return }
+      model.AppendRow(resultRow(path, fp))
+   })
+   
+   return
+}
+
+/* resultRow
+**    Returns the table cells for a reported file or folder.
+*/
+
+func resultRow (path string, fp *FilePrint) []*gui.QStandardItem {
+   ls, rs := Classify(fp)
+   item := sortKey(gui.NewQStandardItem2(path), path)
+   item.SetData(core.NewQVariant1(Category(ls, rs)), CategoryRole)
+   item.SetData(core.NewQVariant1(path), PathRole)
+   
+   return []*gui.QStandardItem{
+      item,
+      stateItem(ls, "upload"),
+      stateItem(rs, "download"),
+      sizeItem(&fp.Local),
+      sizeItem(&fp.Remote),
+      timeItem(&fp.Local),
+      timeItem(&fp.Remote),
+      hashItem(&fp.Local),
+      hashItem(&fp.Remote),
+      sortKey(gui.NewQStandardItem2(Reason(fp)), Reason(fp)),
+   }
+}
+
+/*---------------------------------------------------------------------------
+   showTree
+      Builds up a report as a tree, in which each folder is a node that holds
+   the reported files and folders within it. A folder shows the number of
+   reported files below it, by category. Folders that are not themselves
+   reported have no category.
+---------------------------------------------------------------------------*/
+
+type treeFolder struct {
+   row         []*gui.QStandardItem
+   counts      map[string]int
+   parent      *treeFolder
+}
+
+func showTree (cache *Cache) *ResultsModel {
+   model := NewResultsModel(nil)
+   folders := make(map[string]*treeFolder)
+   
+   // Adds a row under the node for the given folder (nil for the root).
+   add := func (parent *treeFolder, row []*gui.QStandardItem) {
+      if parent == nil { model.AppendRow(row) } else { parent.row[0].AppendRow(row) }
+   }
+   
+   // Returns the node for a folder, creating it (and its parents) if need be.
+   var folder func (string) *treeFolder
+   folder = func (path string) *treeFolder {
+      if path == "." { return nil }
+      if f, ok := folders[path]; ok { return f }
+      
+      row := make([]*gui.QStandardItem, len(ResultColumns))
+      for n := range row { row[n] = sortKey(gui.NewQStandardItem2(""), "") }
+      row[0].SetData(core.NewQVariant1(path), PathRole)
+      
+      f := &treeFolder{ row: row, counts: make(map[string]int), parent: folder(filepath.Dir(path)) }
+      add(f.parent, row)
+      folders[path] = f
+      return f
+   }
    
+   // Entries are visited in sorted order, so a folder is always seen before
+   // its contents.
    cache.Walk(func (path string, fp *FilePrint) {
       if path == "." { return }
       if ! (fp.Local.Changed || fp.Remote.Changed) { return }
       
-      var (lc, rc *gui.QIcon; ls, rs string)
-      if fp.Local.Changed {
-         lc = ReportIcons["upload"]
-         if fp.Remote.Changed {
-            if fp.Remote.ModTime.IsZero() { rs = "X" } else { lc = ReportIcons["conflict"]; rc = lc }
-         } else { rs = "-" }
-      } else {
-         ls = "-"
-         if fp.Remote.Changed { rc = ReportIcons["download"] } else { rs = ls }
+      row := resultRow(path, fp)
+      row[0].SetText(filepath.Base(path))
+      sortKey(row[0], filepath.Base(path))
+      
+      parent := folder(filepath.Dir(path))
+      add(parent, row)
+      
+      if fp.Local.IsDir || fp.Remote.IsDir {
+         folders[path] = &treeFolder{ row: row, counts: make(map[string]int), parent: parent }
+         return
       }
       
-      model.AppendRow([]*gui.QStandardItem{
-         gui.NewQStandardItem2(path),
-         gui.NewQStandardItem3(lc, ls),
-         gui.NewQStandardItem3(rc, rs),
-      })
+      cat := row[0].Data(CategoryRole).ToString()
+      for f := parent; f != nil; f = f.parent { f.counts[cat]++ }
    })
    
-   return
+   // Label each folder with the counts of reported files below it.
+   for path, f := range folders {
+      total := 0
+      detail := make([]string, 0, len(Categories))
+      for _, c := range Categories {
+         if f.counts[c] > 0 {
+            total += f.counts[c]
+            detail = append(detail, fmt.Sprintf("%d %s", f.counts[c], c))
+         }
+      }
+      
+      name := filepath.Base(path)
+      sortKey(f.row[0], name)
+      if total == 0 { f.row[0].SetText(name); continue }
+      
+      summary := fmt.Sprintf("%d changed: %s", total, strings.Join(detail, ", "))
+      f.row[0].SetText(fmt.Sprintf("%s (%d)", name, total))
+      f.row[0].SetToolTip(summary)
+      if f.row[len(f.row) - 1].Text() == "" { f.row[len(f.row) - 1].SetText(summary) }
+   }
+   
+   return model
+}
+
+/* sortKey
+**    Sets the value used to sort a table cell and returns the cell.
+*/
+
+func sortKey (item *gui.QStandardItem, key interface{}) *gui.QStandardItem {
+   item.SetData(core.NewQVariant1(key), SortRole)
+   return item
+}
+
+/* stateItem
+**    Returns a table cell showing the icon or marker for a file state. The
+** 'changed' icon depends on the side (upload or download).
+*/
+
+func stateItem (state int, changed string) *gui.QStandardItem {
+   var item *gui.QStandardItem
+   switch state {
+      case State__Changed: item = gui.NewQStandardItem3(ReportIcons[changed], "")
+      case State__Conflict: item = gui.NewQStandardItem3(ReportIcons["conflict"], "")
+      case State__Missing: item = gui.NewQStandardItem2("X")
+      default: item = gui.NewQStandardItem2("-")
+   }
+   return sortKey(item, state)
+}
+
+/* sizeItem, timeItem, hashItem
+**    Return table cells for the optional columns. Each is blank if the file
+** is missing (or is a folder, for size and hash).
+*/
+
+func sizeItem (fi *FileInfo) *gui.QStandardItem {
+   if fi.ModTime.IsZero() || fi.IsDir { return sortKey(gui.NewQStandardItem2(""), int64(-1)) }
+   return sortKey(gui.NewQStandardItem2(strconv.FormatInt(fi.Size, 10)), fi.Size)
+}
+
+func timeItem (fi *FileInfo) *gui.QStandardItem {
+   if fi.ModTime.IsZero() { return sortKey(gui.NewQStandardItem2(""), int64(0)) }
+   item := gui.NewQStandardItem2(fi.ModTime.Local().Format("2006-01-02 15:04:05"))
+   return sortKey(item, fi.ModTime.Unix())
+}
+
+func hashItem (fi *FileInfo) *gui.QStandardItem {
+   if fi.Hash == nil { return sortKey(gui.NewQStandardItem2(""), "") }
+   item := gui.NewQStandardItem2(hex.EncodeToString(fi.Hash)[:8])
+   item.SetToolTip(hex.EncodeToString(fi.Hash))
+   return sortKey(item, hex.EncodeToString(fi.Hash))
 }
 
 /*---------------------------------------------------------------------------
@@ -76,7 +335,57 @@ type ResultsModel struct {
 */
 
 func (m *ResultsModel) init () {
-   m.SetHorizontalHeaderLabels([]string{"Path", "Local", "Remote"})
+   m.SetHorizontalHeaderLabels(ResultColumns)
+}
+
+/*---------------------------------------------------------------------------
+   ResultsFilter [model]
+      Proxy model that sits between the results model and the report view,
+   to sort the rows and hide those that do not match the current filter.
+---------------------------------------------------------------------------*/
+
+type ResultsFilter struct {
+   core.QSortFilterProxyModel
+   
+   pattern     *regexp.Regexp
+   hidden      map[string]bool
+   
+   _ func() `constructor:"init"`
+}
+
+/* init
+**    Sets up sorting and attaches the custom row filter.
+*/
+
+func (m *ResultsFilter) init () {
+   m.hidden = make(map[string]bool)
+   m.SetSortRole(SortRole)
+   m.SetDynamicSortFilter(true)
+   m.SetRecursiveFilteringEnabled(true)
+   m.ConnectFilterAcceptsRow(m.acceptsRow)
+}
+
+/* SetFilter
+**    Changes the path pattern (nil for all) and the set of hidden categories
+** and re-applies the filter.
+*/
+
+func (m *ResultsFilter) SetFilter (pattern *regexp.Regexp, hidden map[string]bool) {
+   m.pattern = pattern
+   m.hidden = hidden
+   m.InvalidateFilter()
+}
+
+/* acceptsRow
+**    Returns 'true' if the given row of the source model should be shown.
+*/
+
+func (m *ResultsFilter) acceptsRow (row int, parent *core.QModelIndex) bool {
+   index := m.SourceModel().Index(row, 0, parent)
+   cat := index.Data(CategoryRole).ToString()
+   if cat == "" || m.hidden[cat] { return false } // folders shown via contents
+   if m.pattern == nil { return true }
+   return m.pattern.MatchString(index.Data(PathRole).ToString())
 }
 
 /*---------------------------------------------------------------------------
@@ -84,10 +393,14 @@ func (m *ResultsModel) init () {
 ---------------------------------------------------------------------------*/
 
 type ReportView struct {
-   widgets.QTableView
+   widgets.QTreeView
+   
+   proxy       *ResultsFilter
    
    _ func() `constructor:"init"`
    _ func(bool) `signal:"rowSelected"`
+   _ func(string) `signal:"folderChosen"`
+   _ func(string) `signal:"folderExported"`
 }
 
 /* init
@@ -96,8 +409,14 @@ type ReportView struct {
 */
 
 func (w *ReportView) init () {
+   w.proxy = NewResultsFilter(w)
+   w.QTreeView.SetModel(w.proxy)
    w.SetModel(nil)
    w.SetSelectionBehavior(widgets.QAbstractItemView__SelectRows)
+   w.SetUniformRowHeights(true)
+   w.SetAllColumnsShowFocus(true)
+   w.SetSortingEnabled(true)
+   w.SortByColumn(0, core.Qt__AscendingOrder)
    w.SetMinimumWidth(450)
    
    d := NewCenteredItemDelegate(nil)
@@ -109,25 +428,92 @@ func (w *ReportView) init () {
       w.RowSelected(len(add.Indexes()) > 0)
    })
    
-   w.ConnectDoubleClicked(func (_ *core.QModelIndex) {
-      w.ViewSelected()
+   w.ConnectDoubleClicked(func (index *core.QModelIndex) {
+      if ! w.Model().HasChildren(index) { w.ViewSelected() }
    })
+   
+   header := w.Header()
+   header.SetContextMenuPolicy(core.Qt__CustomContextMenu)
+   header.ConnectCustomContextMenuRequested(w.columnMenu)
+   
+   w.SetContextMenuPolicy(core.Qt__CustomContextMenu)
+   w.ConnectCustomContextMenuRequested(w.folderMenu)
 }
 
 /* SetModel
-**    Augments default behaviour to stretch first column (path).
+**    Sets the source model behind the sort/filter proxy, so the current
+** filter still applies to the new results. Also stretches the first column
+** (path), hides optional columns not chosen for this site and shows the
+** expand/collapse controls in tree mode.
 */
 
 func (w *ReportView) SetModel (m *ResultsModel) {
    if m == nil {
-      prev := w.Model()
+      prev := w.proxy.SourceModel()
       if prev != nil && prev.RowCount(core.NewQModelIndex()) == 0 { return }
       m = NewResultsModel(nil)
    }
    
-   w.QTableView.SetModel(m)
-   w.HorizontalHeader().
+   w.proxy.SetSourceModel(m)
+   w.SetRootIsDecorated(Config.TreeView)
+   w.Header().
       SetSectionResizeMode2(0, widgets.QHeaderView__Stretch)
+   
+   for n := FixedColumns; n < len(ResultColumns); n++ {
+      w.SetColumnHidden(n, ! Config.ColumnShown(ResultColumns[n]))
+   }
+}
+
+/* SetFilter
+**    Applies a new filter to the report rows.
+*/
+
+func (w *ReportView) SetFilter (pattern *regexp.Regexp, hidden map[string]bool) {
+   w.proxy.SetFilter(pattern, hidden)
+}
+
+/* columnMenu
+**    Pops up a menu (on right click in the table header) to show or hide the
+** optional columns. The choice is saved with the site.
+*/
+
+func (w *ReportView) columnMenu (pos *core.QPoint) {
+   menu := widgets.NewQMenu(w)
+   for n := FixedColumns; n < len(ResultColumns); n++ {
+      col := n
+      act := menu.AddAction(ResultColumns[n])
+      act.SetCheckable(true)
+      act.SetChecked(! w.IsColumnHidden(n))
+      act.ConnectTriggered(func (checked bool) {
+         w.SetColumnHidden(col, ! checked)
+         Config.ShowColumn(ResultColumns[col], checked)
+      })
+   }
+   menu.Exec2(w.Header().MapToGlobal(pos), nil)
+}
+
+/* folderMenu
+**    Pops up a menu (on right click on a folder, in tree mode) with actions
+** that apply to the folder as a whole.
+*/
+
+func (w *ReportView) folderMenu (pos *core.QPoint) {
+   index := w.IndexAt(pos)
+   if ! index.IsValid() || ! w.Model().HasChildren(index) { return }
+   index = index.Sibling(index.Row(), 0)
+   path := index.Data(PathRole).ToString()
+   
+   menu := widgets.NewQMenu(w)
+   act := menu.AddAction("Expand All")
+   act.ConnectTriggered(func (bool) { w.ExpandRecursively(index, -1) })
+   act = menu.AddAction("Collapse")
+   act.ConnectTriggered(func (bool) { w.Collapse(index) })
+   act = menu.AddAction("Show Only This Folder")
+   act.ConnectTriggered(func (bool) { w.FolderChosen(path) })
+   menu.AddSeparator()
+   act = menu.AddAction("Export Patch for Folder...")
+   act.ConnectTriggered(func (bool) { w.FolderExported(path) })
+   menu.Exec2(w.Viewport().MapToGlobal(pos), nil)
 }
 
 /* ViewSelected
@@ -138,8 +524,117 @@ func (w *ReportView) SetModel (m *ResultsModel) {
 func (w *ReportView) ViewSelected () error {
    s := w.SelectedIndexes()
    if len(s) == 0 { return nil }
-   path := s[0].Data(int(core.Qt__EditRole)).ToString()
-   return ViewFile(path)
+   index := s[0].Sibling(s[0].Row(), 0)
+   if w.Model().HasChildren(index) {
+      w.ExpandRecursively(index, -1)
+      return nil
+   }
+   return ViewFile(index.Data(PathRole).ToString())
+}
+
+/*---------------------------------------------------------------------------
+   ReportFilter [widget]
+      Search box and category toggles used to filter the report. Emits the
+   'Changed' signal when the filter is edited.
+---------------------------------------------------------------------------*/
+
+type ReportFilter struct {
+   widgets.QWidget
+   
+   search      *widgets.QLineEdit
+   mode        *widgets.QComboBox
+   toggles     map[string]*widgets.QToolButton
+   
+   _ func() `constructor:"init"`
+   _ func() `signal:"Changed"`
+}
+
+/* init
+**    Creates the search box, a choice of 'glob' or 'regex' pattern and one
+** toggle button per report category.
+*/
+
+func (f *ReportFilter) init () {
+   layout := widgets.NewQHBoxLayout2(f)
+   layout.SetContentsMargins(0, 0, 0, 0)
+   
+   f.search = widgets.NewQLineEdit(nil); layout.AddWidget(f.search, 1, 0)
+   f.search.SetPlaceholderText("Filter paths")
+   f.search.SetClearButtonEnabled(true)
+   f.mode = widgets.NewQComboBox(nil); layout.AddWidget(f.mode, 0, 0)
+   f.mode.AddItems([]string{"Glob", "Regex"})
+   
+   LoadReportIcons()
+   f.toggles = make(map[string]*widgets.QToolButton)
+   for _, c := range Categories {
+      bn := widgets.NewQToolButton(nil); layout.AddWidget(bn, 0, 0)
+      if ic, ok := ReportIcons[c]; ok { bn.SetIcon(ic) } else { bn.SetText("X") }
+      bn.SetToolTip("Show " + c + " rows")
+      bn.SetCheckable(true)
+      bn.SetChecked(true)
+      bn.ConnectToggled(func (bool) { f.Changed() })
+      f.toggles[c] = bn
+   }
+   
+   f.search.ConnectTextChanged(func (string) { f.Changed() })
+   f.mode.ConnectCurrentIndexChanged(func (int) { f.Changed() })
+}
+
+/* Pattern
+**    Returns the path pattern as a regular expression, or nil if the search
+** box is empty. A 'glob' pattern without wildcards matches any part of the
+** path; otherwise it must match the whole path, with '*' matching any
+** sequence of characters (including separators).
+*/
+
+func (f *ReportFilter) Pattern () (*regexp.Regexp, error) {
+   text := f.search.Text()
+   if text == "" { return nil, nil }
+   if f.mode.CurrentIndex() == 1 { return regexp.Compile(text) }
+   
+   expr := regexp.QuoteMeta(text)
+   if strings.ContainsAny(text, "*?") {
+      expr = strings.ReplaceAll(expr, `\*`, ".*")
+      expr = strings.ReplaceAll(expr, `\?`, ".")
+      expr = "^" + expr + "$"
+   }
+   return regexp.Compile("(?i)" + expr)
+}
+
+/* Hidden
+**    Returns the set of categories that are toggled off.
+*/
+
+func (f *ReportFilter) Hidden () map[string]bool {
+   hidden := make(map[string]bool)
+   for c, bn := range f.toggles { hidden[c] = ! bn.IsChecked() }
+   return hidden
+}
+
+/* ShowFolder
+**    Sets the search box to show only the contents of a given folder.
+*/
+
+func (f *ReportFilter) ShowFolder (path string) {
+   f.mode.SetCurrentIndex(0)
+   f.search.SetText(filepath.Join(path, "*"))
+}
+
+/* Apply
+**    Applies the current filter to a report view. If the pattern is not
+** valid, the search box is highlighted and the previous filter is kept.
+*/
+
+func (f *ReportFilter) Apply (view *ReportView) {
+   pattern, err := f.Pattern()
+   if err != nil {
+      f.search.SetStyleSheet("color: #b51919;")
+      f.search.SetToolTip(err.Error())
+      return
+   }
+   f.search.SetStyleSheet("")
+   f.search.SetToolTip("")
+   view.SetFilter(pattern, f.Hidden())
 }
 
 /*---------------------------------------------------------------------------
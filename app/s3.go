@@ -0,0 +1,344 @@
+package app
+
+/*
+** This file contains the 's3' scheme for the remote side, which accesses the
+** remote copy in an S3-compatible bucket. The server field holds the bucket
+** name and the root folder is the key prefix. Folders are synthesised from the
+** common prefixes of the object keys. The access key and secret are set for the
+** site, else given as the username and password. Requests are signed with AWS
+** signature version 4.
+*/
+
+import (
+   "os"
+   "io"
+   "fmt"
+   "log"
+   "path"
+   "sort"
+   "time"
+   "bytes"
+   "strings"
+   "net/url"
+   "net/http"
+   "io/ioutil"
+   "crypto/hmac"
+   "crypto/sha256"
+   "encoding/hex"
+   "encoding/xml"
+   "path/filepath"
+)
+
+// Region used when none is configured for the site
+const DefaultRegion = "us-east-1"
+
+/*---------------------------------------------------------------------------
+   dialS3
+      Helper function to create and return a session for an S3 bucket. The
+   root folder is listed, to check the address and keys.
+---------------------------------------------------------------------------*/
+
+func dialS3 (r *RemoteSide) (FTPConn, error) {
+   if Opt.Verbose { log.Println("Opening S3 session") }
+
+   var err error
+   key, secret := r.accessKey, r.secret
+   if key == "" { key = r.Addr.User.Username() }
+   if secret == "" {
+      secret, err = r.getPassword()
+      if err != nil { return nil, err }
+   }
+
+   transport, err := newTransport(r.Site)
+   if err != nil { return nil, err }
+   conn := &S3Conn{
+      client:  &http.Client{ Transport: transport },
+      bucket:  r.Addr.Host,
+      region:  r.Site.Region,
+      key:     key,
+      secret:  secret,
+      etags:   ! r.Site.IgnoreETags,
+   }
+   if conn.region == "" { conn.region = DefaultRegion }
+
+   if endpoint := r.Site.Endpoint; endpoint == "" {
+      // Virtual-hosted style, as preferred by AWS
+      conn.base = &url.URL{
+         Scheme: "https",
+         Host:   conn.bucket + ".s3." + conn.region + ".amazonaws.com",
+      }
+   } else {
+      // Path style, as used by most stand-ins (e.g. MinIO)
+      conn.base, err = url.Parse(endpoint)
+      if err != nil { return nil, err }
+      if conn.base.Host == "" { conn.base = &url.URL{ Scheme: "https", Host: endpoint } }
+      conn.base.Path = "/" + conn.bucket
+   }
+
+   _, err = conn.ReadDir(r.Addr.Path)
+   if err != nil {
+      conn.Close(); return nil, err
+   }
+
+   return conn, nil
+}
+
+/*---------------------------------------------------------------------------
+   S3Conn [type]
+      Implements the same interface as an FTP connection, over the S3 API.
+---------------------------------------------------------------------------*/
+
+type S3Conn struct {
+   client      *http.Client
+   base        *url.URL       // bucket address, without trailing '/'
+   bucket,
+   region,
+   key,
+   secret      string
+   etags       bool           // ETags are MD5 hashes
+}
+
+func (c *S3Conn) Close () error {
+   c.client.CloseIdleConnections()
+   return nil
+}
+
+func (c *S3Conn) ReadDir (dir string) ([]os.FileInfo, error) {
+   prefix := s3Key(dir)
+   if prefix != "" { prefix += "/" }
+
+   list := make([]os.FileInfo, 0)
+   query := url.Values{ "list-type": {"2"}, "prefix": {prefix}, "delimiter": {"/"} }
+   for {
+      resp, err := c.do("GET", "", query, nil)
+      if err != nil { return nil, err }
+      var result s3ListResult
+      err = xml.NewDecoder(resp.Body).Decode(&result)
+      resp.Body.Close()
+      if err != nil { return nil, err }
+
+      for _, p := range result.Prefixes {
+         name := path.Base(strings.TrimSuffix(p.Prefix, "/"))
+         list = append(list, &s3FileInfo{ name: name, dir: true })
+      }
+      for _, obj := range result.Contents {
+         if obj.Key == prefix { continue } // folder placeholder
+         inf := &s3FileInfo{
+            name:  path.Base(obj.Key),
+            size:  obj.Size,
+            mtime: obj.Modified,
+         }
+         if c.etags { inf.etag = obj.ETag }
+         list = append(list, inf)
+      }
+
+      if ! result.Truncated { break }
+      query.Set("continuation-token", result.NextToken)
+   }
+   return list, nil
+}
+
+func (c *S3Conn) Retrieve (path string, dest io.Writer) error {
+   resp, err := c.do("GET", s3Key(path), nil, nil)
+   if err != nil { return err }
+   defer resp.Body.Close()
+
+   _, err = io.Copy(dest, resp.Body)
+   return err
+}
+
+func (c *S3Conn) Store (path string, src io.Reader) error {
+   // The payload must be hashed for signing, so is read in full; the rate
+   // is limited as the request is sent
+   data, err := ioutil.ReadAll(src)
+   if err != nil { return err }
+
+   resp, err := c.do("PUT", s3Key(path), nil, data)
+   if err != nil { return err }
+   resp.Body.Close()
+   return nil
+}
+
+// Uploads are limited by 'do', once the payload is signed
+func (c *S3Conn) throttlesUploads () {}
+
+/* s3Key
+**    Converts a path to an object key (or key prefix), without leading or
+** trailing '/'.
+*/
+
+func s3Key (p string) string {
+   p = path.Clean("/" + filepath.ToSlash(p))
+   return strings.Trim(p, "/")
+}
+
+/* do
+**    Sends a signed request for an object (or for the bucket, if the key is
+** blank). Returns an error for any response other than success.
+*/
+
+func (c *S3Conn) do (method, key string, query url.Values, body []byte) (*http.Response, error) {
+   uri := c.base.Path + "/" + s3Escape(key, true)
+   raw := c.base.Scheme + "://" + c.base.Host + uri
+   qs := s3Query(query)
+   if qs != "" { raw += "?" + qs }
+
+   var reader io.Reader
+   if body != nil { reader = bytes.NewReader(body) }
+   req, err := http.NewRequest(method, raw, reader)
+   if err != nil { return nil, err }
+   c.sign(req, uri, qs, body)
+   throttleRequest(req)
+
+   resp, err := c.client.Do(req)
+   if err != nil { return nil, err }
+   if resp.StatusCode / 100 != 2 {
+      defer resp.Body.Close()
+      var e struct {
+         Code        string
+         Message     string
+      }
+      if xml.NewDecoder(resp.Body).Decode(&e) == nil && e.Code != "" {
+         return nil, fmt.Errorf("S3: %s: %s (%s)", e.Code, e.Message, key)
+      }
+      return nil, fmt.Errorf("S3: %s (%s)", resp.Status, key)
+   }
+   return resp, nil
+}
+
+/* sign
+**    Adds the headers for AWS signature version 4 to a request. The URI and
+** query must be in canonical (escaped) form.
+*/
+
+func (c *S3Conn) sign (req *http.Request, uri, query string, body []byte) {
+   now := time.Now().UTC()
+   stamp := now.Format("20060102T150405Z")
+   day := stamp[:8]
+   payload := sha256.Sum256(body)
+   hash := hex.EncodeToString(payload[:])
+
+   req.Header.Set("X-Amz-Date", stamp)
+   req.Header.Set("X-Amz-Content-Sha256", hash)
+
+   signed := "host;x-amz-content-sha256;x-amz-date"
+   canonical := strings.Join([]string{
+      req.Method, uri, query,
+      "host:" + req.URL.Host,
+      "x-amz-content-sha256:" + hash,
+      "x-amz-date:" + stamp,
+      "",
+      signed,
+      hash,
+   }, "\n")
+
+   scope := day + "/" + c.region + "/s3/aws4_request"
+   sum := sha256.Sum256([]byte(canonical))
+   toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+   key := []byte("AWS4" + c.secret)
+   for _, part := range []string{day, c.region, "s3", "aws4_request"} {
+      key = hmacSHA256(key, part)
+   }
+   req.Header.Set("Authorization", fmt.Sprintf(
+      "AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+      c.key, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign)),
+   ))
+}
+
+func hmacSHA256 (key []byte, data string) []byte {
+   h := hmac.New(sha256.New, key)
+   h.Write([]byte(data))
+   return h.Sum(nil)
+}
+
+/* s3Escape
+**    Escapes a string as required for signing: every byte other than the
+** unreserved characters is escaped (and '/', if so chosen).
+*/
+
+func s3Escape (s string, path bool) string {
+   var buf strings.Builder
+   for _, b := range []byte(s) {
+      switch {
+         case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+            b == '-', b == '.', b == '_', b == '~', path && b == '/':
+            buf.WriteByte(b)
+         default:
+            fmt.Fprintf(&buf, "%%%02X", b)
+      }
+   }
+   return buf.String()
+}
+
+/* s3Query
+**    Returns the query string in canonical form, sorted by name.
+*/
+
+func s3Query (query url.Values) string {
+   parts := make([]string, 0, len(query))
+   for k, vs := range query {
+      for _, v := range vs { parts = append(parts, s3Escape(k, false) + "=" + s3Escape(v, false)) }
+   }
+   sort.Strings(parts)
+   return strings.Join(parts, "&")
+}
+
+/*---------------------------------------------------------------------------
+   s3ListResult [type]
+      Parts of a ListObjectsV2 response used in listing a folder.
+---------------------------------------------------------------------------*/
+
+type s3ListResult struct {
+   Contents    []struct {
+      Key         string
+      Modified    time.Time   `xml:"LastModified"`
+      ETag        string
+      Size        int64
+   }
+   Prefixes    []struct {
+      Prefix      string
+   }                       `xml:"CommonPrefixes"`
+   Truncated   bool        `xml:"IsTruncated"`
+   NextToken   string      `xml:"NextContinuationToken"`
+}
+
+/*---------------------------------------------------------------------------
+   s3FileInfo [type]
+      Details of an object, or a folder synthesised from a key prefix.
+---------------------------------------------------------------------------*/
+
+type s3FileInfo struct {
+   name        string
+   size        int64
+   mtime       time.Time
+   dir         bool
+   etag        string
+}
+
+func (f *s3FileInfo) Name () string { return f.name }
+func (f *s3FileInfo) Size () int64 { return f.size }
+func (f *s3FileInfo) ModTime () time.Time { return f.mtime }
+func (f *s3FileInfo) IsDir () bool { return f.dir }
+func (f *s3FileInfo) Sys () interface{} { return nil }
+
+func (f *s3FileInfo) Mode () os.FileMode {
+   if f.dir { return os.ModeDir | 0755 }
+   return 0644
+}
+
+/* MD5
+**    Returns the MD5 hash of the object content, from its ETag. This is nil
+** for objects uploaded in parts, where the ETag is not a plain MD5 hash. An
+** ETag of 32 hex digits is assumed to be the MD5 hash; that is not so for
+** objects encrypted with SSE-KMS or a customer key, so for such a bucket the
+** ETags are not kept (see 'IgnoreETags').
+*/
+
+func (f *s3FileInfo) MD5 () []byte {
+   tag := strings.Trim(f.etag, `"`)
+   if len(tag) != 32 { return nil }
+   sum, err := hex.DecodeString(tag)
+   if err != nil { return nil }
+   return sum
+}
@@ -0,0 +1,36 @@
+package app
+
+import (
+   "testing"
+   "net/url"
+)
+
+func TestS3Escape (t *testing.T) {
+   tests := []struct {
+      s           string
+      path        bool
+      want        string
+   }{
+      { "a-b_c.d~e", false, "a-b_c.d~e" },
+      { "dir/file name.txt", true, "dir/file%20name.txt" },
+      { "dir/file name.txt", false, "dir%2Ffile%20name.txt" },
+      { "a+b=c&d", false, "a%2Bb%3Dc%26d" },
+      { "café", true, "caf%C3%A9" },
+   }
+   for _, test := range tests {
+      if got := s3Escape(test.s, test.path); got != test.want {
+         t.Errorf("%q (path %v): got %q, want %q", test.s, test.path, got, test.want)
+      }
+   }
+}
+
+func TestS3Query (t *testing.T) {
+   query := url.Values{
+      "prefix":      {"a b/"},
+      "list-type":   {"2"},
+      "delimiter":   {"/"},
+   }
+   want := "delimiter=%2F&list-type=2&prefix=a%20b%2F"
+   if got := s3Query(query); got != want { t.Errorf("got %q, want %q", got, want) }
+   if got := s3Query(url.Values{}); got != "" { t.Errorf("empty: got %q", got) }
+}
@@ -2,7 +2,8 @@ package app
 
 /*
 ** This file contains the logic to scan the local files and folders and match
-** them to remote copies.
+** them to remote copies. The source may instead be another remote copy (see
+** remotesource.go), in which case its listing drives the scan.
 */
 
 import (
@@ -13,15 +14,19 @@ import (
    "bytes"
    "log"
    "io"
+   "time"
    "bufio"
    "hash"
    "crypto/md5"
+   "unicode/utf8"
+   "encoding/binary"
 )
 
 /*---------------------------------------------------------------------------
    ScanFolders
       Initiates a local and remote scan for the identified source folder and
-   corresponding remote path.
+   corresponding remote path. A connection is also opened to the source, if
+   it is a remote copy.
 ---------------------------------------------------------------------------*/
 
 func ScanFolders (cache *Cache, errors chan<- error, stop <-chan bool) {
@@ -30,42 +35,24 @@ func ScanFolders (cache *Cache, errors chan<- error, stop <-chan bool) {
    conn, err := DialRemote()
 	if err == nil {
 		defer conn.Close()
-
-		s := Scanner{
-			Cache:         cache,
-			Conn:          conn,
-			Local:         Config.Source,
-			Remote:        Config.RemoteAddr.Path,
-			Exclude:       make([]string, 0, len(Config.Exclude)),
-			BinaryFiles:   make(map[string]bool),
-		}
-
-		// Expand any 'exclude' patterns that start with '@': each of these
-		// refers to a file to read in. Each line of that file (which itself
-		// is also ignored) is used as an additional pattern.
-		for _, x := range strings.Split(Config.Exclude, "|") {
-			if strings.HasPrefix(x, "@") {
-				path := x[1:]
-				s.Exclude = append(s.Exclude, path)
-				if ! filepath.IsAbs(path) { path = filepath.Join(Config.Source, path) }
-				f, err := os.Open(path)
-				if err != nil { continue }
-				scanner := bufio.NewScanner(f)
-				for scanner.Scan() { s.Exclude = append(s.Exclude, scanner.Text()) }
-				f.Close()
-			} else {
-				s.Exclude = append(s.Exclude, x)
+		s := NewScanner(cache, conn)
+		if Config.RemoteSource() != nil {
+			var src FTPConn
+			src, err = DialSource()
+			if err == nil {
+				defer src.Close()
+				s.SetSource(src)
 			}
 		}
-
-		if Opt.Verbose { log.Printf("Excluding:    %s\n", s.Exclude) }
-
-		// Make boolean 'map' of binary file extensions
-		for _, b := range strings.Split(Config.BinaryFiles, "|") {
-			s.BinaryFiles[b] = true
+		if err == nil {
+			if cache.Ignore != s.Ignore {
+				// Fingerprints were computed with different text options
+				cache.Rehash()
+				cache.Ignore = s.Ignore
+			}
+			err = s.Walk(stop)
+			if err == nil { cache.PruneBases() }
 		}
-
-		err = s.Walk(stop)
 	}
 
 	errors <- err
@@ -81,10 +68,106 @@ func ScanFolders (cache *Cache, errors chan<- error, stop <-chan bool) {
 type Scanner struct {
    Cache       *Cache
    Conn        FTPConn
+   Source      FTPConn        // remote source, if not a local folder
    Local,
    Remote      string
    Exclude     []string
    BinaryFiles map[string]bool
+   Ignore      TextOptions
+   Tolerance   time.Duration  // allowed difference in remote file times
+}
+
+/*---------------------------------------------------------------------------
+   NewScanner
+      Creates a scanner for the current site, using the given cache and
+   remote connection. The 'exclude' and 'binary' lists are expanded from
+   the site configuration. For a remote source, 'Local' is the root folder
+   on the source server, and the caller must set the connection (see
+   'SetSource').
+---------------------------------------------------------------------------*/
+
+func NewScanner (cache *Cache, conn FTPConn) *Scanner {
+   s := &Scanner{
+      Cache:         cache,
+      Conn:          conn,
+      Local:         Config.Source,
+      Remote:        Config.RemoteAddr.Path,
+      BinaryFiles:   make(map[string]bool),
+      Ignore:        Config.Ignore,
+      Tolerance:     time.Duration(Config.TimeTolerance) * time.Second,
+   }
+   if src := Config.RemoteSource(); src != nil { s.Local = src.Path }
+   s.expandExcludes()
+
+   // Make boolean 'map' of binary file extensions
+   for _, b := range strings.Split(Config.BinaryFiles, "|") {
+      s.BinaryFiles[b] = true
+   }
+   
+   return s
+}
+
+/*---------------------------------------------------------------------------
+   Scanner::SetSource
+      Sets the connection to a remote source. The 'exclude' files given
+   relative to the source are read through it.
+---------------------------------------------------------------------------*/
+
+func (s *Scanner) SetSource (conn FTPConn) {
+   s.Source = conn
+   s.expandExcludes()
+}
+
+/* expandExcludes
+**    Expands any 'exclude' patterns that start with '@': each of these
+** refers to a file to read in. Each line of that file (which itself is also
+** ignored) is used as an additional pattern.
+*/
+
+func (s *Scanner) expandExcludes () {
+   s.Exclude = make([]string, 0, len(Config.Exclude))
+   for _, x := range strings.Split(Config.Exclude, "|") {
+      if strings.HasPrefix(x, "@") {
+         path := x[1:]
+         s.Exclude = append(s.Exclude, path)
+         s.Exclude = append(s.Exclude, s.readPatterns(path)...)
+      } else {
+         s.Exclude = append(s.Exclude, x)
+      }
+   }
+
+   if Opt.Verbose { log.Printf("Excluding:    %s\n", s.Exclude) }
+}
+
+/* readPatterns
+**    Returns the lines of an 'exclude' file, or none if it can't be read. A
+** relative path is from the root of the source; for a remote source, the
+** file is read through its connection, once that is set.
+*/
+
+func (s *Scanner) readPatterns (path string) []string {
+   var text io.Reader
+   switch {
+      case filepath.IsAbs(path) || Config.RemoteSource() == nil: {
+         if ! filepath.IsAbs(path) { path = filepath.Join(Config.Source, path) }
+         f, err := os.Open(path)
+         if err != nil { return nil }
+         defer f.Close()
+         text = f
+      }
+      case s.Source != nil: {
+         var buf bytes.Buffer
+         if s.Source.Retrieve(filepath.Join(s.Local, path), &buf) != nil { return nil }
+         text = &buf
+      }
+      default:
+         return nil
+   }
+
+   lines := make([]string, 0)
+   scanner := bufio.NewScanner(text)
+   for scanner.Scan() { lines = append(lines, scanner.Text()) }
+   return lines
 }
 
 /*---------------------------------------------------------------------------
@@ -94,6 +177,7 @@ type Scanner struct {
 ---------------------------------------------------------------------------*/
 
 func (s *Scanner) Walk (stop <-chan bool) error {
+   if s.Source != nil { return s.WalkSource(".", time.Time{}, stop) }
    return filepath.Walk(
       Config.Source,
       func (path string, info os.FileInfo, err error) error {
@@ -122,6 +206,82 @@ func (s *Scanner) Walk (stop <-chan bool) error {
    )
 }
 
+/*---------------------------------------------------------------------------
+   Scanner::WalkRemote
+      Traverses the remote file tree only, starting from the given relative
+   path, and updates the remote fingerprint for each file found. This is used
+   when there is no local copy to drive the scan (e.g. checking the remote
+   against a manifest).
+---------------------------------------------------------------------------*/
+
+func (s *Scanner) WalkRemote (path string, stop <-chan bool) error {
+   select {
+      case _ = <-stop:
+         return errors.New("Scan aborted")
+      default:
+         // continue
+   }
+   
+   rel := path; if rel == "." { rel = s.Remote }
+   if Opt.Verbose { log.Printf("Entering %s\n", rel) }
+   qMain.ShowStatus(rel)
+   
+   dir, err := s.Conn.ReadDir(filepath.Join(s.Remote, path))
+   if err != nil { return err }
+   
+   for _, inf := range dir {
+      rel := filepath.Join(path, inf.Name())
+      if s.excluded(rel) { continue }
+      if inf.IsDir() {
+         ent := s.Cache.AddEntry(rel)
+         ent.Remote = FileInfo{
+            IsDir: true, ModTime: inf.ModTime(), Size: 0,
+         }
+         err = s.WalkRemote(rel, stop)
+         if err != nil { return err }
+      } else {
+         s.CheckRemote(rel, inf)
+      }
+   }
+   
+   return nil
+}
+
+/*---------------------------------------------------------------------------
+   Scanner::WalkSource
+      Traverses the tree of a remote source, starting from the given relative
+   path, in the same order as 'Walk' does for a local folder: each folder is
+   entered (fetching the remote copy) before its files are checked.
+---------------------------------------------------------------------------*/
+
+func (s *Scanner) WalkSource (path string, mtime time.Time, stop <-chan bool) error {
+   err := s.enterFolder(path, mtime)
+   if err == filepath.SkipDir { return nil }
+   if err != nil { return err }
+   
+   dir, err := s.Source.ReadDir(filepath.Join(s.Local, path))
+   if err != nil { return err }
+   
+   for _, inf := range dir {
+      select {
+         case _ = <-stop:
+            return errors.New("Scan aborted")
+         default:
+            // continue
+      }
+      
+      rel := filepath.Join(path, inf.Name())
+      if inf.IsDir() {
+         err = s.WalkSource(rel, inf.ModTime(), stop)
+      } else {
+         err = s.CheckSource(rel, inf)
+      }
+      if err != nil { return err }
+   }
+   
+   return nil
+}
+
 /*---------------------------------------------------------------------------
    Scanner::EnterFolder
       This method is called when a new folder is entered. It fetches the
@@ -131,6 +291,10 @@ func (s *Scanner) Walk (stop <-chan bool) error {
 ---------------------------------------------------------------------------*/
 
 func (s *Scanner) EnterFolder (path string, info os.FileInfo) error {
+   return s.enterFolder(path, info.ModTime())
+}
+
+func (s *Scanner) enterFolder (path string, mtime time.Time) error {
    if s.excluded(path) { return filepath.SkipDir }
    rel := path; if rel == "." { rel = s.Local }
    if Opt.Verbose { log.Printf("Entering %s\n", rel) }
@@ -138,7 +302,7 @@ func (s *Scanner) EnterFolder (path string, info os.FileInfo) error {
    
    // Add this folder to the cache (if not already present).
    ent := s.Cache.AddEntry(path)
-   ent.Local = FileInfo{ IsDir: true, ModTime: info.ModTime(), Size: 0 }
+   ent.Local = FileInfo{ IsDir: true, ModTime: mtime, Size: 0 }
    
    // Read remote copy of this folder
    dir, err := s.Conn.ReadDir(filepath.Join(s.Remote, path))
@@ -177,8 +341,9 @@ func (s *Scanner) CheckLocal (path string, info os.FileInfo) error {
    if s.excluded(path) { return nil }
    
 	ent := s.Cache.AddEntry(path)
-   if ! ent.Local.ModTime.Equal(info.ModTime()) || ent.Local.Size != info.Size() {
+   if ent.Local.Stale || ! ent.Local.ModTime.Equal(info.ModTime()) || ent.Local.Size != info.Size() {
       ent.Local.Changed = true
+      ent.Local.Stale = false
       ent.Local.ModTime = info.ModTime()
       ent.Local.Size = info.Size()
    
@@ -186,8 +351,7 @@ func (s *Scanner) CheckLocal (path string, info os.FileInfo) error {
       if err != nil { return err } // Abort scan
       defer f.Close()
       
-      hash := md5.New()
-      if ! s.isBinary(path) { hash = NewTextHash(hash) }
+      hash := s.newHash(path)
       
       _, err = io.Copy(hash, f)
       if err != nil {
@@ -201,7 +365,11 @@ func (s *Scanner) CheckLocal (path string, info os.FileInfo) error {
       if bytes.Equal(ent.Local.Hash, ent.Remote.Hash) {
          ent.Local.Changed = false
          ent.Remote.Changed = false
+         if ! s.isBinary(path) { s.Cache.SaveBase(path, ent) }
       }
+   } else if ent.Base == nil && ent.Local.Hash != nil && bytes.Equal(ent.Local.Hash, ent.Remote.Hash) {
+      // Files that were already in step have no base until now
+      if ! s.isBinary(path) { s.Cache.SaveBase(path, ent) }
    }
    return nil
 }
@@ -218,26 +386,80 @@ func (s *Scanner) CheckRemote (path string, info os.FileInfo) error {
 	qMain.ShowStatus(path)
 	
    ent := s.Cache.AddEntry(path)
-   if ! ent.Remote.ModTime.Equal(info.ModTime()) || ent.Remote.Size != info.Size() {
-      ent.Remote.Changed = true
-      ent.Remote.ModTime = info.ModTime()
-      ent.Remote.Size = info.Size()
+   return s.checkCopy(s.Conn, s.Remote, path, info, &ent.Remote)
+}
+
+/*---------------------------------------------------------------------------
+   Scanner::CheckSource
+      This method is called for each file in a remote source, in place of
+   'CheckLocal'. The fingerprint is updated in the same way as for the remote
+   copy; then, as for a local file, a new hash that matches the remote copy
+   clears the changes on both sides.
+---------------------------------------------------------------------------*/
+
+func (s *Scanner) CheckSource (path string, info os.FileInfo) error {
+   if s.excluded(path) { return nil }
+	qMain.ShowStatus(path)
+	
+   ent := s.Cache.AddEntry(path)
+   err := s.checkCopy(s.Source, s.Local, path, info, &ent.Local)
+   if err == nil && ent.Local.Changed && bytes.Equal(ent.Local.Hash, ent.Remote.Hash) {
+      ent.Local.Changed = false
+      ent.Remote.Changed = false
+   }
+   return err
+}
+
+/* checkCopy
+**    Updates the fingerprint of one copy of a file, held on a server under
+** the given root folder, if its size or time has changed (or it is stale).
+*/
+
+func (s *Scanner) checkCopy (conn FTPConn, root, path string, info os.FileInfo, fp *FileInfo) error {
+   if fp.Stale || ! s.sameTime(fp.ModTime, info) || fp.Size != info.Size() {
+      tag := remoteMD5(info)
+      if ! fp.Stale && tag != nil && fp.Size == info.Size() && bytes.Equal(tag, fp.Tag) {
+         // Content unchanged, according to the server
+         fp.ModTime = info.ModTime()
+         return nil
+      }
+      
+      fp.Changed = true
+      fp.Stale = false
+      fp.ModTime = info.ModTime()
+      fp.Size = info.Size()
+      fp.Tag = tag
+      
+      if tag != nil && s.isBinary(path) {
+         // The fingerprint of a binary file is the MD5 hash of its content
+         fp.Hash = tag
+         return nil
+      }
       
       // Fetch the file and compute an MD5 hash
-      hash := md5.New()
-      if ! s.isBinary(path) { hash = NewTextHash(hash) }
+      hash := s.newHash(path)
       
-      err := s.Conn.Retrieve(filepath.Join(s.Remote, path), hash)
+      err := conn.Retrieve(filepath.Join(root, path), hash)
       if err != nil {
          if Opt.Verbose { log.Printf("Retrieve (%s): %v\n", path, err) }
-         ent.Remote.Hash = nil
+         fp.Hash = nil
          return err
       }
-      ent.Remote.Hash = hash.Sum(nil)
+      fp.Hash = hash.Sum(nil)
    }
    return nil
 }
 
+/* remoteMD5
+**    Returns the MD5 hash of a remote file's content, if known without
+** fetching it (e.g. from an S3 ETag), else nil.
+*/
+
+func remoteMD5 (info os.FileInfo) []byte {
+   if f, ok := info.(interface{ MD5 () []byte }); ok { return f.MD5() }
+   return nil
+}
+
 /*---------------------------------------------------------------------------
    excluded
       Helper function that compares a given file path with the patterns in
@@ -268,6 +490,21 @@ func (s *Scanner) isBinary (path string) bool {
    return false
 }
 
+/*---------------------------------------------------------------------------
+   newHash
+      Returns a hash provider for the fingerprint of a given file. Text files
+   are normalised according to the 'ignore' options.
+---------------------------------------------------------------------------*/
+
+func (s *Scanner) newHash (path string) hash.Hash {
+   hash := md5.New()
+   switch {
+      case s.isBinary(path): return hash
+      case s.Ignore.Any(): return NewNormalHash(hash, s.Ignore)
+   }
+   return NewTextHash(hash)
+}
+
 /*---------------------------------------------------------------------------
    NewTextHash
       Returns an object that wraps a crypto hash provider within a function
@@ -288,4 +525,151 @@ func (h TextHash) Write (p []byte) (int, error) {
    b := bytes.ReplaceAll(p, []byte("\r\n"), []byte("\n"))
    _, err := h.Hash.Write(b)
    return len(p), err
+}
+
+/*---------------------------------------------------------------------------
+   TextOptions [type]
+      Options to ignore 'cosmetic' differences in text files, such as those
+   introduced by reformatting.
+---------------------------------------------------------------------------*/
+
+type TextOptions struct {
+   IgnoreTrailing,
+   IgnoreSpace,
+   IgnoreBlank,
+   IgnoreCase,
+   IgnoreEncoding bool
+}
+
+/* Any
+**    Returns 'true' if any of the options are set.
+*/
+
+func (o TextOptions) Any () bool {
+   return o.IgnoreTrailing || o.IgnoreSpace || o.IgnoreBlank || o.IgnoreCase || o.IgnoreEncoding
+}
+
+/* normalise
+**    Normalises a single line of text (without its line ending) according to
+** the options. Returns 'false' if the line should be dropped altogether.
+** To ignore the encoding, any line that is not valid UTF-8 is taken to be
+** Windows-1252 (or ISO-8859-1) and converted.
+*/
+
+func (o TextOptions) normalise (line []byte) ([]byte, bool) {
+   if o.IgnoreEncoding && ! utf8.Valid(line) { line = []byte(decode8bit(line, "Windows-1252")) }
+   if o.IgnoreBlank && len(bytes.TrimSpace(line)) == 0 { return nil, false }
+   if o.IgnoreSpace { line = bytes.Join(bytes.Fields(line), nil) }
+   if o.IgnoreTrailing { line = bytes.TrimRight(line, " \t\r\f\v") }
+   if o.IgnoreCase { line = bytes.ToLower(line) }
+   return line, true
+}
+
+/*---------------------------------------------------------------------------
+   NormaliseText
+      Returns the text as it is seen when computing the fingerprint with the
+   given options (line endings are always folded to '\n').
+---------------------------------------------------------------------------*/
+
+func NormaliseText (text string, o TextOptions) string {
+   var buf bytes.Buffer
+   h := NormalHash{ Hash: nil, opts: o }
+   h.emit = func (b []byte) { buf.Write(b) }
+   h.Write([]byte(text))
+   h.flush()
+   return buf.String()
+}
+
+/*---------------------------------------------------------------------------
+   NewNormalHash
+      Returns an object that wraps a crypto hash provider within a function
+   that normalises each line of text according to the 'ignore' options, as
+   well as folding line endings. Because lines are buffered, the final
+   (incomplete) line is only added when 'Sum' is called.
+      To ignore the encoding, a byte order mark is removed and UTF-16 text
+   is converted to UTF-8 before it is split into lines.
+---------------------------------------------------------------------------*/
+
+func NewNormalHash (h hash.Hash, o TextOptions) hash.Hash {
+   n := &NormalHash{ Hash: h, opts: o }
+   n.emit = func (b []byte) { h.Write(b) }
+   return n
+}
+
+type NormalHash struct {
+   hash.Hash
+   opts        TextOptions
+   raw,
+   pending     []byte
+   started     bool
+   order       binary.ByteOrder
+   emit        func ([]byte)
+}
+
+func (h *NormalHash) Write (p []byte) (int, error) {
+   if h.opts.IgnoreEncoding {
+      h.decode(p, false)
+   } else { h.pending = append(h.pending, p...) }
+   for {
+      n := bytes.IndexByte(h.pending, '\n')
+      if n < 0 { break }
+      line := bytes.TrimSuffix(h.pending[:n], []byte("\r"))
+      if line, ok := h.opts.normalise(line); ok {
+         h.emit(line); h.emit([]byte("\n"))
+      }
+      h.pending = h.pending[n+1:]
+   }
+   return len(p), nil
+}
+
+func (h *NormalHash) Sum (b []byte) []byte {
+   h.flush()
+   return h.Hash.Sum(b)
+}
+
+func (h *NormalHash) Reset () {
+   h.raw, h.pending = nil, nil
+   h.started, h.order = false, nil
+   h.Hash.Reset()
+}
+
+func (h *NormalHash) flush () {
+   if h.opts.IgnoreEncoding { h.decode(nil, true) }
+   if len(h.pending) > 0 {
+      if line, ok := h.opts.normalise(h.pending); ok { h.emit(line) }
+      h.pending = nil
+   }
+}
+
+/* decode
+**    Adds raw bytes to the pending text, for the 'ignore encoding' option.
+** The byte order mark is checked once the first few bytes are known. UTF-16
+** is converted in whole code units, keeping back any odd byte (or the first
+** half of a surrogate pair) until the next write.
+*/
+
+func (h *NormalHash) decode (p []byte, final bool) {
+   h.raw = append(h.raw, p...)
+   if ! h.started {
+      if len(h.raw) < len(bomUTF8) && ! final { return }
+      h.started = true
+      switch {
+         case bytes.HasPrefix(h.raw, bomUTF8): h.raw = h.raw[len(bomUTF8):]
+         case bytes.HasPrefix(h.raw, bomUTF16LE): h.raw, h.order = h.raw[2:], binary.LittleEndian
+         case bytes.HasPrefix(h.raw, bomUTF16BE): h.raw, h.order = h.raw[2:], binary.BigEndian
+      }
+   }
+   if h.order == nil {
+      h.pending = append(h.pending, h.raw...)
+      h.raw = nil
+      return
+   }
+
+   n := len(h.raw) &^ 1
+   if ! final && n >= 2 {
+      if u := h.order.Uint16(h.raw[n-2:]); u >= 0xd800 && u < 0xdc00 { n -= 2 }
+   }
+   if final { n = len(h.raw) }
+   h.pending = append(h.pending, decodeUTF16(h.raw[:n], h.order)...)
+   h.raw = append([]byte(nil), h.raw[n:]...)
 }
\ No newline at end of file
@@ -0,0 +1,149 @@
+package app
+
+import (
+   "os"
+   "bytes"
+   "testing"
+   "net/url"
+   "crypto/md5"
+   "io/ioutil"
+   "path/filepath"
+)
+
+/* writeFiles
+**    Creates the given files (and their folders) under a folder.
+*/
+
+func writeFiles (t *testing.T, dir string, files map[string]string) {
+   for name, text := range files {
+      path := filepath.Join(dir, filepath.FromSlash(name))
+      if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil { t.Fatal(err) }
+      if err := ioutil.WriteFile(path, []byte(text), 0644); err != nil { t.Fatal(err) }
+   }
+}
+
+/* tempDir
+**    Creates an empty temporary folder, which the caller must remove.
+*/
+
+func tempDir (t *testing.T) string {
+   dir, err := ioutil.TempDir("", "ftpsync")
+   if err != nil { t.Fatal(err) }
+   return dir
+}
+
+/* scanFolders
+**    Scans a local folder against a 'remote' folder reached through 'dialFile',
+** in the same way as 'ScanFolders', and returns the cache.
+*/
+
+func scanFolders (t *testing.T, local, remote string) *Cache {
+   saved := Config
+   defer func () { Config = saved }()
+   Config = &SiteConfig{
+      Source:        local,
+      RemoteAddr:    &url.URL{ Scheme: "file", Path: filepath.ToSlash(remote) },
+      Exclude:       ".git|*.bak",
+      BinaryFiles:   ".png",
+   }
+
+   conn, err := dialFile(Config.remoteSide())
+   if err != nil { t.Fatal(err) }
+   defer conn.Close()
+
+   cache := NewCache()
+   if err = NewScanner(cache, conn).Walk(make(chan bool)); err != nil { t.Fatal(err) }
+   return cache
+}
+
+func TestScannerWalk (t *testing.T) {
+   local, remote := tempDir(t), tempDir(t)
+   defer os.RemoveAll(local)
+   defer os.RemoveAll(remote)
+   writeFiles(t, local, map[string]string{
+      "same.txt":         "one\ntwo\n",
+      "endings.txt":      "one\r\ntwo\r\n",
+      "differs.txt":      "one\n",
+      "local.txt":        "local only\n",
+      "sub/same.txt":     "nested\n",
+      "old.bak":          "excluded\n",
+      ".git/config":      "excluded\n",
+   })
+   writeFiles(t, remote, map[string]string{
+      "same.txt":         "one\ntwo\n",
+      "endings.txt":      "one\ntwo\n",
+      "differs.txt":      "two\n",
+      "remote.txt":       "remote only\n",
+      "sub/same.txt":     "nested\n",
+      "old.bak":          "changed\n",
+   })
+
+   cache := scanFolders(t, local, remote)
+
+   for path, want := range map[string]string{
+      "same.txt":         "",
+      "endings.txt":      "",
+      filepath.Join("sub", "same.txt"): "",
+      "differs.txt":      "Content differs",
+      "local.txt":        "Missing remote",
+      "remote.txt":       "Missing local",
+   } {
+      fp, ok := cache.FilePrints[path]
+      if ! ok { t.Errorf("%s: not in cache", path); continue }
+      if got := Reason(fp); got != want { t.Errorf("%s: got %q, want %q", path, got, want) }
+   }
+   for _, path := range []string{"old.bak", ".git", filepath.Join(".git", "config")} {
+      if _, ok := cache.FilePrints[path]; ok { t.Errorf("%s: excluded path in cache", path) }
+   }
+}
+
+/*---------------------------------------------------------------------------
+   Fingerprints of text
+---------------------------------------------------------------------------*/
+
+func normalSum (text string, o TextOptions) []byte {
+   h := NewNormalHash(md5.New(), o)
+   h.Write([]byte(text))
+   return h.Sum(nil)
+}
+
+func TestNormalHash (t *testing.T) {
+   tests := []struct {
+      a, b        string
+      o           TextOptions
+      same        bool
+   }{
+      { "a b\n", "a b  \n", TextOptions{ IgnoreTrailing: true }, true },
+      { "a b\n", "a  b\n", TextOptions{ IgnoreTrailing: true }, false },
+      { "a b\n", "ab\n", TextOptions{ IgnoreSpace: true }, true },
+      { "a\n\nb\n", "a\nb\n\n", TextOptions{ IgnoreBlank: true }, true },
+      { "a\nb\n", "a\nc\n", TextOptions{ IgnoreBlank: true }, false },
+      { "Hello\n", "hELLO\n", TextOptions{ IgnoreCase: true }, true },
+      { "a\r\nb", "a\nb", TextOptions{ IgnoreCase: true }, true },
+      { "caf\xc3\xa9\n", "caf\xe9\n", TextOptions{ IgnoreEncoding: true }, true },
+      { "\xef\xbb\xbfab\n", "ab\n", TextOptions{ IgnoreEncoding: true }, true },
+      { "\xff\xfea\x00b\x00\n\x00", "ab\n", TextOptions{ IgnoreEncoding: true }, true },
+      { "\xfe\xff\x00a\x00b\x00\n", "ab\n", TextOptions{ IgnoreEncoding: true }, true },
+      { "caf\xc3\xa9\n", "caf\xe9\n", TextOptions{ IgnoreCase: true }, false },
+   }
+   for n, test := range tests {
+      same := bytes.Equal(normalSum(test.a, test.o), normalSum(test.b, test.o))
+      if same != test.same { t.Errorf("%d: %q and %q: same = %v", n, test.a, test.b, same) }
+   }
+}
+
+func TestNormalHashWrites (t *testing.T) {
+   // The result must not depend on how the text is split between writes
+   text := "\xff\xfeL\x00i\x00n\x00e\x00 \x00\r\x00\n\x00\x3d\xd8\x00\xde\n\x00"
+   o := TextOptions{ IgnoreEncoding: true, IgnoreTrailing: true }
+   want := normalSum(text, o)
+   for size := 1; size < len(text); size++ {
+      h := NewNormalHash(md5.New(), o)
+      for n := 0; n < len(text); n += size {
+         end := n + size; if end > len(text) { end = len(text) }
+         h.Write([]byte(text[n:end]))
+      }
+      if ! bytes.Equal(h.Sum(nil), want) { t.Errorf("writes of %d bytes: hash differs", size) }
+   }
+   if got := NormaliseText(text, o); got != "Line\n\U0001f600\n" { t.Errorf("NormaliseText: got %q", got) }
+}
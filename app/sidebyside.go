@@ -0,0 +1,303 @@
+package app
+
+/*
+** This file contains the logic to lay out a line-based comparison of the local
+** and remote copies of a file as two columns, for the 'side by side' mode of
+** the file viewer.
+*/
+
+import (
+   "fmt"
+   "html"
+   "strings"
+   dmp "github.com/sergi/go-diff/diffmatchpatch"
+)
+
+/*---------------------------------------------------------------------------
+   DiffRow [type]
+      One row of a side-by-side comparison. A line number of zero means there
+   is no line on that side. For a 'skipped' row, the left line number holds
+   the count of unchanged lines that were left out.
+---------------------------------------------------------------------------*/
+
+type DiffRow struct {
+   Type        int
+   Left,
+   Right       string
+   LeftNo,
+   RightNo     int
+}
+
+const (
+   Row__Equal = iota
+   Row__Changed
+   Row__Deleted
+   Row__Inserted
+   Row__Skipped
+)
+
+// Number of unchanged lines kept either side of a change, when collapsed
+const CollapseContext = 3
+
+/*---------------------------------------------------------------------------
+   LineDiff
+      Computes the differences between two texts, line by line, rather than
+   character by character.
+---------------------------------------------------------------------------*/
+
+func LineDiff (text1, text2 string) []dmp.Diff {
+   d := dmp.New()
+   c1, c2, lines := d.DiffLinesToChars(text1, text2)
+   diffs := d.DiffMain(c1, c2, false)
+   return d.DiffCharsToLines(diffs, lines)
+}
+
+/*---------------------------------------------------------------------------
+   SideBySide
+      Converts a line-based diff into rows. Deleted lines are paired with the
+   inserted lines that follow them, so that a changed line appears opposite
+   its replacement.
+---------------------------------------------------------------------------*/
+
+func SideBySide (diffs []dmp.Diff) []DiffRow {
+   rows := make([]DiffRow, 0)
+   ln, rn := 1, 1
+   var dels, ins []string
+
+   flush := func () {
+      for n := 0; n < len(dels) || n < len(ins); n++ {
+         row := DiffRow{ Type: Row__Changed }
+         if n < len(dels) { row.Left = dels[n]; row.LeftNo = ln; ln++ } else {
+            row.Type = Row__Inserted
+         }
+         if n < len(ins) { row.Right = ins[n]; row.RightNo = rn; rn++ } else {
+            row.Type = Row__Deleted
+         }
+         rows = append(rows, row)
+      }
+      dels, ins = nil, nil
+   }
+
+   for _, d := range diffs {
+      lines := splitLines(d.Text)
+      switch d.Type {
+         case dmp.DiffDelete: dels = append(dels, lines...)
+         case dmp.DiffInsert: ins = append(ins, lines...)
+         case dmp.DiffEqual: {
+            flush()
+            for _, l := range lines {
+               rows = append(rows, DiffRow{ Row__Equal, l, l, ln, rn })
+               ln++; rn++
+            }
+         }
+      }
+   }
+   flush()
+
+   return rows
+}
+
+/*---------------------------------------------------------------------------
+   NormalRows
+      Compares two texts line by line as normalised with the 'ignore'
+   options, but lays out the rows with the original lines, so that only the
+   differences that are not ignored are marked. A line dropped altogether
+   (such as a blank line) is shown as unchanged, opposite a gap.
+---------------------------------------------------------------------------*/
+
+func NormalRows (text1, text2 string, o TextOptions) []DiffRow {
+   lines1, lines2 := splitLines(text1), splitLines(text2)
+   keys1, kept1 := normalLines(lines1, o)
+   keys2, kept2 := normalLines(lines2, o)
+
+   rows := make([]DiffRow, 0)
+   var i1, i2, k1, k2 int
+   var dels, ins []int
+
+   // Adds the lines dropped on each side before the given lines
+   dropped := func (to1, to2 int) {
+      for ; i1 < to1; i1++ { rows = append(rows, DiffRow{ Row__Equal, lines1[i1], "", i1 + 1, 0 }) }
+      for ; i2 < to2; i2++ { rows = append(rows, DiffRow{ Row__Equal, "", lines2[i2], 0, i2 + 1 }) }
+   }
+   flush := func () {
+      for n := 0; n < len(dels) || n < len(ins); n++ {
+         row := DiffRow{ Type: Row__Changed }
+         if n < len(dels) { row.Left, row.LeftNo = lines1[dels[n]], dels[n] + 1 } else {
+            row.Type = Row__Inserted
+         }
+         if n < len(ins) { row.Right, row.RightNo = lines2[ins[n]], ins[n] + 1 } else {
+            row.Type = Row__Deleted
+         }
+         rows = append(rows, row)
+      }
+      dels, ins = nil, nil
+   }
+
+   for _, d := range LineDiff(keys1, keys2) {
+      n := strings.Count(d.Text, "\n")
+      switch d.Type {
+         case dmp.DiffDelete: {
+            for ; n > 0; n-- { for ; i1 <= kept1[k1]; i1++ { dels = append(dels, i1) }; k1++ }
+         }
+         case dmp.DiffInsert: {
+            for ; n > 0; n-- { for ; i2 <= kept2[k2]; i2++ { ins = append(ins, i2) }; k2++ }
+         }
+         case dmp.DiffEqual: {
+            flush()
+            for ; n > 0; n-- {
+               dropped(kept1[k1], kept2[k2])
+               rows = append(rows, DiffRow{ Row__Equal, lines1[i1], lines2[i2], i1 + 1, i2 + 1 })
+               i1++; i2++; k1++; k2++
+            }
+         }
+      }
+   }
+   flush()
+   dropped(len(lines1), len(lines2))
+
+   return rows
+}
+
+/* normalLines
+**    Returns the normalised lines that are kept, as text for 'LineDiff', and
+** the index of the original line for each.
+*/
+
+func normalLines (lines []string, o TextOptions) (string, []int) {
+   var buf strings.Builder
+   kept := make([]int, 0, len(lines))
+   for n, l := range lines {
+      key, ok := o.normalise([]byte(l))
+      if ! ok { continue }
+      buf.Write(key)
+      buf.WriteByte('\n')
+      kept = append(kept, n)
+   }
+   return buf.String(), kept
+}
+
+/*---------------------------------------------------------------------------
+   NormalCharDiff
+      Computes the differences for the 'inline' mode in the same way: lines
+   that match once normalised are shown as they are in the first text, and
+   each block of changed lines is compared character by character.
+---------------------------------------------------------------------------*/
+
+func NormalCharDiff (text1, text2 string, o TextOptions) []dmp.Diff {
+   diffs := make([]dmp.Diff, 0)
+   var left, right strings.Builder
+
+   flush := func () {
+      if left.Len() > 0 || right.Len() > 0 {
+         diffs = append(diffs, CharDiff(left.String(), right.String())...)
+      }
+      left.Reset(); right.Reset()
+   }
+
+   for _, row := range NormalRows(text1, text2, o) {
+      switch {
+         case row.Type == Row__Equal && row.LeftNo > 0: {
+            flush()
+            diffs = append(diffs, dmp.Diff{ Type: dmp.DiffEqual, Text: row.Left + "\n" })
+         }
+         case row.Type == Row__Equal:
+            // dropped from the second text only: nothing to show
+         default: {
+            if row.LeftNo > 0 { left.WriteString(row.Left + "\n") }
+            if row.RightNo > 0 { right.WriteString(row.Right + "\n") }
+         }
+      }
+   }
+   flush()
+
+   return diffs
+}
+
+/* splitLines
+**    Splits text into lines, without the line endings.
+*/
+
+func splitLines (text string) []string {
+   lines := strings.SplitAfter(text, "\n")
+   if lines[len(lines) - 1] == "" { lines = lines[:len(lines) - 1] }
+   for n, l := range lines { lines[n] = strings.TrimRight(l, "\r\n") }
+   return lines
+}
+
+/*---------------------------------------------------------------------------
+   CollapseRows
+      Replaces each long run of unchanged rows with a single 'skipped' row,
+   keeping a few lines of context next to each change.
+---------------------------------------------------------------------------*/
+
+func CollapseRows (rows []DiffRow, context int) []DiffRow {
+   out := make([]DiffRow, 0, len(rows))
+   for n := 0; n < len(rows); {
+      if rows[n].Type != Row__Equal { out = append(out, rows[n]); n++; continue }
+
+      end := n
+      for end < len(rows) && rows[end].Type == Row__Equal { end++ }
+
+      head, tail := context, context
+      if n == 0 { head = 0 }
+      if end == len(rows) { tail = 0 }
+
+      if end - n > head + tail + 1 {
+         out = append(out, rows[n:n+head]...)
+         out = append(out, DiffRow{ Type: Row__Skipped, LeftNo: end - n - head - tail })
+         out = append(out, rows[end-tail:end]...)
+      } else {
+         out = append(out, rows[n:end]...)
+      }
+      n = end
+   }
+   return out
+}
+
+/*---------------------------------------------------------------------------
+   SideHtml
+      Returns the rich text (HTML) for one side of a side-by-side comparison,
+   with line numbers. The first row of each block of changes has an anchor
+   named "c<n>", for navigation. Also returns the number of such blocks.
+---------------------------------------------------------------------------*/
+
+func SideHtml (rows []DiffRow, left bool) (string, int) {
+   var buf strings.Builder
+   buf.WriteString("<table width=\"100%\" cellspacing=\"0\" cellpadding=\"1\">")
+
+   blocks := 0
+   for n, row := range rows {
+      text, num, colour := row.Right, row.RightNo, "#e0f2f4"
+      if left { text, num, colour = row.Left, row.LeftNo, "#fbe3e3" }
+
+      anchor := ""
+      if row.Type != Row__Equal && row.Type != Row__Skipped &&
+         (n == 0 || rows[n-1].Type == Row__Equal || rows[n-1].Type == Row__Skipped) {
+         anchor = fmt.Sprintf("<a name=\"c%d\"></a>", blocks)
+         blocks++
+      }
+
+      switch {
+         case row.Type == Row__Skipped:
+            text = fmt.Sprintf("<i>... %d unchanged lines ...</i>", row.LeftNo)
+            num, colour = 0, "#eeeeee"
+         case num == 0:
+            text, colour = "&nbsp;", "#f4f4f4"
+         default:
+            if text == "" { text = "&nbsp;" } else { text = html.EscapeString(text) }
+            if row.Type == Row__Equal { colour = "#ffffff" }
+      }
+
+      lineNo := ""
+      if num > 0 { lineNo = fmt.Sprintf("%d", num) }
+      fmt.Fprintf(
+         &buf,
+         "<tr bgcolor=\"%s\"><td align=\"right\" style=\"color:#888888;\">%s%s&nbsp;</td>" +
+         "<td width=\"100%%\"><pre style=\"margin:0;\">%s</pre></td></tr>",
+         colour, anchor, lineNo, text,
+      )
+   }
+
+   buf.WriteString("</table>")
+   return buf.String(), blocks
+}
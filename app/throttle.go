@@ -0,0 +1,183 @@
+package app
+
+/*
+** This file contains the bandwidth limit for transfers to and from the remote
+** copy. Every connection returned by 'DialRemote' passes the data for each file
+** through a rate-limited reader or writer, sharing one limit, so the total rate
+** stays below the cap however the transfers are made. The limit is set for each
+** site, may be overridden on the command line, and may be changed while a scan
+** is running. The rate is only set from the GUI thread, never when dialling. The HTTP-based connections limit each request body themselves,
+** so that a body sent again (e.g. after a login challenge) is limited too.
+*/
+
+import (
+   "io"
+   "sync"
+   "time"
+   "net/http"
+)
+
+// Shared limit for all transfers
+var Throttle = &RateLimiter{}
+
+/*---------------------------------------------------------------------------
+   BandwidthLimit
+      Returns the bandwidth limit, in KB/s, for the current session: as set
+   on the command line (or from the status bar), else as set for the site.
+   Zero means no limit.
+---------------------------------------------------------------------------*/
+
+func BandwidthLimit () int {
+   if Opt.Bandwidth >= 0 { return Opt.Bandwidth }
+   return Config.Bandwidth
+}
+
+/*---------------------------------------------------------------------------
+   SetBandwidthLimit
+      Changes the bandwidth limit, in KB/s, taking effect at once for any
+   transfers in progress. As for a limit given on the command line, this
+   overrides the limit for the site for the rest of the session, and is not
+   saved. It must be called from the GUI thread.
+---------------------------------------------------------------------------*/
+
+func SetBandwidthLimit (kb int) {
+   Opt.Bandwidth = kb
+   Throttle.SetRate(kb)
+}
+
+/*---------------------------------------------------------------------------
+   RateLimiter [type]
+      Keeps the bytes transferred to the set rate, by making each transfer
+   wait until the bytes sent before it are paid for. The rate may be changed
+   at any time, from any goroutine.
+---------------------------------------------------------------------------*/
+
+type RateLimiter struct {
+   mu          sync.Mutex
+   rate        int64          // bytes per second; zero for no limit
+   next        time.Time      // when the bytes so far are paid for
+}
+
+/* SetRate
+**    Sets the limit, in KB/s. Zero removes the limit.
+*/
+
+func (l *RateLimiter) SetRate (kb int) {
+   l.mu.Lock()
+   defer l.mu.Unlock()
+   l.rate = int64(kb) * 1024
+   l.next = time.Time{}
+}
+
+/* chunk
+**    Returns how many of 'n' bytes to transfer in one go, so that a change
+** to the rate takes effect within a fraction of a second.
+*/
+
+func (l *RateLimiter) chunk (n int) int {
+   l.mu.Lock()
+   defer l.mu.Unlock()
+   if l.rate <= 0 { return n }
+   max := int(l.rate / 4)
+   if max < 512 { max = 512 }
+   if n > max { n = max }
+   return n
+}
+
+/* wait
+**    Waits long enough for 'n' bytes at the current rate.
+*/
+
+func (l *RateLimiter) wait (n int) {
+   l.mu.Lock()
+   if l.rate <= 0 || n <= 0 { l.mu.Unlock(); return }
+   now := time.Now()
+   if l.next.Before(now) { l.next = now }
+   l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+   delay := l.next.Sub(now)
+   l.mu.Unlock()
+   time.Sleep(delay)
+}
+
+/* throttleWriter, throttleReader
+**    Pass data through at no more than the rate of the limiter.
+*/
+
+type throttleWriter struct {
+   w           io.Writer
+   limit       *RateLimiter
+}
+
+func (t *throttleWriter) Write (p []byte) (n int, err error) {
+   for len(p) > 0 {
+      var m int
+      m, err = t.w.Write(p[:t.limit.chunk(len(p))])
+      n += m
+      t.limit.wait(m)
+      if err != nil { return }
+      p = p[m:]
+   }
+   return
+}
+
+type throttleReader struct {
+   r           io.Reader
+   limit       *RateLimiter
+}
+
+func (t *throttleReader) Read (p []byte) (int, error) {
+   if len(p) == 0 { return t.r.Read(p) }
+   n, err := t.r.Read(p[:t.limit.chunk(len(p))])
+   t.limit.wait(n)
+   return n, err
+}
+
+/*---------------------------------------------------------------------------
+   throttleRequest
+      Limits the rate at which the body of an HTTP request is sent. The
+   body from 'GetBody', for a request sent again, is limited in the same way.
+   The length of the body is unchanged.
+---------------------------------------------------------------------------*/
+
+func throttleRequest (req *http.Request) {
+   if req.Body == nil || req.Body == http.NoBody { return }
+   req.Body = throttleBody(req.Body)
+   if get := req.GetBody; get != nil {
+      req.GetBody = func () (io.ReadCloser, error) {
+         body, err := get()
+         if err != nil { return nil, err }
+         return throttleBody(body), nil
+      }
+   }
+}
+
+func throttleBody (body io.ReadCloser) io.ReadCloser {
+   return struct {
+      io.Reader
+      io.Closer
+   }{ &throttleReader{ body, Throttle }, body }
+}
+
+/*---------------------------------------------------------------------------
+   throttledConn [type]
+      Wrapper for a remote connection, which limits the rate of each file
+   fetched or stored (unless the connection limits its uploads itself).
+---------------------------------------------------------------------------*/
+
+type throttledConn struct {
+   FTPConn
+}
+
+// A connection that limits the rate of its own uploads
+type uploadThrottler interface {
+   throttlesUploads ()
+}
+
+func (c throttledConn) Retrieve (path string, dest io.Writer) error {
+   return c.FTPConn.Retrieve(path, &throttleWriter{ dest, Throttle })
+}
+
+func (c throttledConn) Store (path string, src io.Reader) error {
+   if _, ok := c.FTPConn.(uploadThrottler); ok { return c.FTPConn.Store(path, src) }
+   return c.FTPConn.Store(path, &throttleReader{ src, Throttle })
+}
@@ -1,6 +1,8 @@
 package app
 
 import (
+   "os"
+   "fmt"
    "io/ioutil"
    "strings"
    "html"
@@ -15,35 +17,185 @@ import (
    ViewFile
       Fetches the remote and local copies of a given file, identified by
    relative path, and compares them to detect differences. Then displays
-   the annotated text in a popup window.
+   the annotated text in a popup window. The work is done in the background
+   (see 'FetchView'), so this returns straight away.
 ---------------------------------------------------------------------------*/
 
 func ViewFile (path string) error {
-   qMain.TempStatus("Fetching remote copy ...")
+   return qMain.beginView(path)
+}
+
+/*---------------------------------------------------------------------------
+   ViewResult [type]
+      The files fetched for the viewer, and their differences (if computed),
+   passed back from 'FetchView' to the main window.
+---------------------------------------------------------------------------*/
+
+type ViewResult struct {
+   Path        string
+   Site        *SiteConfig
+   Conn,
+   Source      FTPConn        // remote source, if any
+   Local,
+   Remote      string
+   LocalText,
+   RemoteText  string         // as compared, converted to UTF-8
+   Overlay     []byte         // image differences, as from 'ImageDiff'
+   Differ      int
+   ImageErr    error
+   Summary     *FileSummary
+   Inline,
+   Lines       []dmp.Diff
+   Err         error
+}
+
+/*---------------------------------------------------------------------------
+   FetchView
+      Runs as a goroutine to fetch the files to be viewed, in the same way
+   as 'ScanFolders'. The remote copy is streamed to a temporary file first;
+   if either copy is beyond the size limit, only a summary is produced. For
+   text files and images, the differences are computed here too.
+      Open connections (to the remote copy, and to a remote source) may be
+   given, to be used if they still work. The connections used are passed
+   back with the result, to be used again.
+---------------------------------------------------------------------------*/
+
+func FetchView (path string, size int64, conn, src FTPConn, results chan<- *ViewResult, stop <-chan bool) {
+   r := &ViewResult{ Path: path, Site: Config, Conn: conn, Source: src }
+   r.Err = r.fetch(size, stop)
+   results <- r
+   qMain.ViewReady()
+}
+
+func (r *ViewResult) fetch (size int64, stop <-chan bool) error {
+   qMain.ShowStatus("Fetching remote copy ...")
    
-   conn, err := DialRemote()
-   if err != nil { return err }
-   defer conn.Close()
+   var tmp string
+   var err error
+   if r.Conn != nil {
+      tmp, err = FetchRemoteTemp(r.Conn, r.Path, size, stop)
+      if err != nil { r.Conn.Close(); r.Conn = nil }
+      if err == E_Cancelled { return err }
+   }
+   if r.Conn == nil {
+      conn, err := DialRemote()
+      if err != nil { return err }
+      tmp, err = FetchRemoteTemp(conn, r.Path, size, stop)
+      if err != nil { conn.Close(); return err }
+      r.Conn = conn
+   }
+   defer os.Remove(tmp)
    
-   var buf strings.Builder
-   err = conn.Retrieve(filepath.Join(Config.RemoteAddr.Path, path), &buf)
-   if err != nil { return err }
+   local := filepath.Join(Config.Source, r.Path)
+   if Config.RemoteSource() != nil {
+      qMain.ShowStatus("Fetching source copy ...")
+      local, err = r.fetchSource(stop)
+      if err != nil { return err }
+      defer os.Remove(local)
+   }
+   if fileSize(local) > ViewLimit() || fileSize(tmp) > ViewLimit() {
+      r.Summary, err = SummariseFiles(local, tmp)
+      return err
+   }
    
-   text1, err := ioutil.ReadFile(filepath.Join(Config.Source, path))
+   ltext, err := ioutil.ReadFile(local)
    if err != nil { return err }
+   rtext, err := ioutil.ReadFile(tmp)
+   if err != nil { return err }
+   r.Local, r.Remote = string(ltext), string(rtext)
    
+   switch ContentKind(r.Path, ltext, rtext) {
+      case Content__Image: {
+         qMain.ShowStatus("Comparing ...")
+         r.Overlay, r.Differ, r.ImageErr = ImageDiff(ltext, rtext)
+      }
+      case Content__Text: {
+         qMain.ShowStatus("Comparing ...")
+         r.LocalText = DecodeText(ltext, DetectEncoding(ltext))
+         r.RemoteText = DecodeText(rtext, DetectEncoding(rtext))
+         r.Lines = LineDiff(r.LocalText, r.RemoteText)
+         if len(r.Local) <= InlineLimit && len(r.Remote) <= InlineLimit {
+            r.Inline = CharDiff(r.LocalText, r.RemoteText)
+         }
+      }
+   }
+   return nil
+}
+
+/* fileSize
+**    Returns the size of a file, or zero if it can't be found.
+*/
+
+func fileSize (path string) int64 {
+   info, err := os.Stat(path)
+   if err != nil { return 0 }
+   return info.Size()
+}
+
+/* fetchSource
+**    Streams the copy of the file from a remote source to a temporary file,
+** using the connection given to 'FetchView' if it still works.
+*/
+
+func (r *ViewResult) fetchSource (stop <-chan bool) (string, error) {
+   var tmp string
+   var err error
+   if r.Source != nil {
+      tmp, err = FetchSourceTemp(r.Source, r.Path, stop)
+      if err != nil { r.Source.Close(); r.Source = nil }
+      if err == nil || err == E_Cancelled { return tmp, err }
+   }
+   conn, err := DialSource()
+   if err != nil { return "", err }
+   tmp, err = FetchSourceTemp(conn, r.Path, stop)
+   if err != nil { conn.Close(); return "", err }
+   r.Source = conn
+   return tmp, nil
+}
+
+/*---------------------------------------------------------------------------
+   FetchFile
+      Returns the text of the local and remote copies of a given file, using
+   an open connection to fetch the latter. For a remote source, the open
+   connection to it is given too (else nil).
+---------------------------------------------------------------------------*/
+
+func FetchFile (conn, src FTPConn, path string) (local, remote string, err error) {
+   remote, err = FetchRemote(conn, path)
+   if err != nil { return }
+   
+   local, err = FetchLocal(src, path)
+   return
+}
+
+/* FetchLocal, FetchRemote
+**    Return the text of just the local (or remote source) or remote copy of
+** a file.
+*/
+
+func FetchLocal (src FTPConn, path string) (string, error) {
+   if src != nil { return fetchSource(src, path) }
+   text, err := ioutil.ReadFile(filepath.Join(Config.Source, path))
+   return string(text), err
+}
+
+func FetchRemote (conn FTPConn, path string) (string, error) {
+   var buf strings.Builder
+   err := conn.Retrieve(filepath.Join(Config.RemoteAddr.Path, path), &buf)
+   return buf.String(), err
+}
+
+/*---------------------------------------------------------------------------
+   CharDiff
+      Computes the character-level differences between two texts, as shown
+   in the 'inline' mode of the file viewer.
+---------------------------------------------------------------------------*/
+
+func CharDiff (text1, text2 string) []dmp.Diff {
    d := dmp.New()
-   diffs := d.DiffMain(string(text1), buf.String(), false)
+   diffs := d.DiffMain(text1, text2, false)
    d.DiffCleanupSemantic(diffs)
-   
-   // Load difference text and show dialog
-   
-   if viewer == nil { viewer = NewFileViewer(nil, 0) }
-   viewer.SetPath(path)
-   viewer.SetHtml(diffs)
-   viewer.Open()
-   
-   return nil
+   return diffs
 }
 
 /*---------------------------------------------------------------------------
@@ -57,10 +209,43 @@ type FileViewer struct {
    
    path     *widgets.QLabel
    text     *widgets.QTextEdit
+   left,
+   right    *widgets.QTextEdit
+   pages    *widgets.QStackedWidget
+   images   [3]*widgets.QLabel
+   info     *widgets.QLabel
+   sideBySide,
+   collapse *widgets.QCheckBox
+   ignore   []*widgets.QCheckBox
+   encoding [2]*widgets.QComboBox
+   prev,
+   next,
+   push,
+   pull,
+   save,
+   merge    *widgets.QPushButton
+   
+   kind     int
+   editable bool
+   file,
+   local,
+   remote   string
+   summary  *FileSummary
+   pre      *ViewResult
+   changes,
+   current  int
    
    _ func() `constructor:"init"`
 }
 
+// Key to the colours used in each mode
+const (
+   inlineKey = "Key: <ins style=\"color:#329ea8;\">New in remote;</ins> unchanged; <del style=\"background-color:#c2c2c2;color:#b51919;text-decoration:line-through;\">new in local.</del>"
+   sideKey = "Left: local copy; right: remote copy. Key: <span style=\"background-color:#fbe3e3;\">changed in local</span> <span style=\"background-color:#e0f2f4;\">changed in remote</span>"
+   hexKey = "Left: local copy; right: remote copy. Key: <span style=\"background-color:#fbe3e3;\">bytes differ</span>"
+   imageKey = "Left: local copy; centre: remote copy; right: <span style=\"color:#e01010;\">%d pixels differ</span>"
+)
+
 var viewer *FileViewer
 
 /* init
@@ -73,24 +258,96 @@ func (d *FileViewer) init () {
    d.path = widgets.NewQLabel(nil, 0)
    layout.AddWidget(d.path, 0, 0)
    
+   row := widgets.NewQHBoxLayout()
+   d.sideBySide = widgets.NewQCheckBox2("Side by side", nil); row.AddWidget(d.sideBySide, 0, 0)
+   d.collapse = widgets.NewQCheckBox2("Collapse unchanged", nil); row.AddWidget(d.collapse, 0, 0)
+   row.AddStretch(1)
+   d.prev = widgets.NewQPushButton2("Previous", nil); row.AddWidget(d.prev, 0, 0)
+   d.next = widgets.NewQPushButton2("Next", nil); row.AddWidget(d.next, 0, 0)
+   d.push = widgets.NewQPushButton2("Push to Remote", nil); row.AddWidget(d.push, 0, 0)
+   d.pull = widgets.NewQPushButton2("Pull to Local", nil); row.AddWidget(d.pull, 0, 0)
+   layout.AddLayout(row, 0)
+   
+   row = widgets.NewQHBoxLayout()
+   row.AddWidget(widgets.NewQLabel2("Ignore:", nil, 0), 0, 0)
+   for _, label := range []string{"Trailing space", "All space", "Blank lines", "Case"} {
+      cb := widgets.NewQCheckBox2(label, nil)
+      cb.ConnectToggled(func (bool) { d.refresh() })
+      row.AddWidget(cb, 0, 0)
+      d.ignore = append(d.ignore, cb)
+   }
+   row.AddStretch(1)
+   for n, label := range []string{"Local encoding:", "Remote encoding:"} {
+      row.AddWidget(widgets.NewQLabel2(label, nil, 0), 0, 0)
+      d.encoding[n] = widgets.NewQComboBox(nil)
+      d.encoding[n].AddItems(append([]string{"Auto"}, Encodings...))
+      d.encoding[n].ConnectCurrentIndexChanged(func (int) { d.refresh() })
+      row.AddWidget(d.encoding[n], 0, 0)
+   }
+   layout.AddLayout(row, 0)
+   
+   d.pages = widgets.NewQStackedWidget(nil)
+   layout.AddWidget(d.pages, 1, 0)
+   
    d.text = widgets.NewQTextEdit(nil)
-   layout.AddWidget(d.text, 1, 0)
+   d.pages.AddWidget(d.text)
    //d.text.SetLineWrapMode(widgets.QTextEdit__NoWrap)
    d.text.SetReadOnly(true)
    
-   info := widgets.NewQLabel(nil, 0)
-   info.SetTextFormat(core.Qt__RichText)
-   info.SetText("Key: <ins style=\"color:#329ea8;\">New in remote;</ins> unchanged; <del style=\"background-color:#c2c2c2;color:#b51919;text-decoration:line-through;\">new in local.</del>")
-   layout.AddWidget(info, 0, 0)
+   split := widgets.NewQSplitter(nil)
+   d.pages.AddWidget(split)
+   d.left = widgets.NewQTextEdit(nil); split.AddWidget(d.left)
+   d.right = widgets.NewQTextEdit(nil); split.AddWidget(d.right)
+   for _, t := range []*widgets.QTextEdit{d.left, d.right} {
+      t.SetReadOnly(true)
+      t.SetLineWrapMode(widgets.QTextEdit__NoWrap)
+   }
+   
+   // Keep both sides scrolled to the same place
+   lv, rv := d.left.VerticalScrollBar(), d.right.VerticalScrollBar()
+   lv.ConnectValueChanged(rv.SetValue)
+   rv.ConnectValueChanged(lv.SetValue)
+   lh, rh := d.left.HorizontalScrollBar(), d.right.HorizontalScrollBar()
+   lh.ConnectValueChanged(rh.SetValue)
+   rh.ConnectValueChanged(lh.SetValue)
+   
+   scroll := widgets.NewQScrollArea(nil)
+   d.pages.AddWidget(scroll)
+   pics := widgets.NewQWidget(nil, 0)
+   grid := widgets.NewQGridLayout(pics)
+   for n, label := range []string{"Local", "Remote", "Difference"} {
+      grid.AddWidget2(widgets.NewQLabel2(label, nil, 0), 0, n, core.Qt__AlignHCenter)
+      d.images[n] = widgets.NewQLabel(nil, 0)
+      grid.AddWidget2(d.images[n], 1, n, core.Qt__AlignHCenter | core.Qt__AlignTop)
+   }
+   grid.SetRowStretch(2, 1)
+   scroll.SetWidget(pics)
+   scroll.SetWidgetResizable(true)
+   
+   d.info = widgets.NewQLabel(nil, 0)
+   d.info.SetTextFormat(core.Qt__RichText)
+   d.info.SetText(inlineKey)
+   layout.AddWidget(d.info, 0, 0)
+   
+   d.sideBySide.ConnectToggled(func (bool) { d.refresh() })
+   d.collapse.ConnectToggled(func (bool) { d.refresh() })
+   d.prev.ConnectClicked(func (bool) { d.showChange(d.current - 1) })
+   d.next.ConnectClicked(func (bool) { d.showChange(d.current + 1) })
+   d.push.ConnectClicked(func (bool) { d.applyHunk(true) })
+   d.pull.ConnectClicked(func (bool) { d.applyHunk(false) })
    
    buttons := widgets.NewQDialogButtonBox3(
       widgets.QDialogButtonBox__Ok,
       nil,
    )
    layout.AddWidget(buttons, 1, 0)
+   d.save = buttons.AddButton2("Save as Patch", widgets.QDialogButtonBox__ActionRole)
+   d.merge = buttons.AddButton2("Merge", widgets.QDialogButtonBox__ActionRole)
    
    buttons.ConnectAccepted(d.Accept)
    buttons.ConnectRejected(d.Reject)
+   d.save.ConnectClicked(d.savePatch)
+   d.merge.ConnectClicked(d.openMerge)
 }
 
 /* SetPath
@@ -99,16 +356,417 @@ func (d *FileViewer) init () {
 */
 
 func (d *FileViewer) SetPath (path string) {
+   d.file = path
    d.SetWindowTitle(filepath.Base(path) + " - " + gui.QGuiApplication_ApplicationDisplayName())
    d.path.SetText("Viewing " + path)
 }
 
+/* savePatch
+**    Handles the 'save as patch' button. Saves the differences for the file
+** being viewed as a unified diff.
+*/
+
+func (d *FileViewer) savePatch (bool) {
+   patch := UnifiedDiff(d.file, d.local, d.remote, true, true)
+   if patch == "" {
+      widgets.QMessageBox_Information(
+         d, "Save as Patch", "The local and remote copies are the same.",
+         widgets.QMessageBox__Ok, widgets.QMessageBox__NoButton,
+      )
+      return
+   }
+   
+   path := widgets.QFileDialog_GetSaveFileName(
+      d,
+      "Save as Patch",
+      filepath.Base(d.file) + ".patch",
+      "Patch files (*.patch *.diff);;All files (*)",
+      "",
+      0,
+   )
+   if path == "" { return }
+   
+   err := ioutil.WriteFile(path, []byte(patch), 0644)
+   if err != nil {
+      widgets.QMessageBox_Critical(
+         d, "Error", fmt.Sprintf("Save patch: %v", err),
+         widgets.QMessageBox__Ok, widgets.QMessageBox__NoButton,
+      )
+   }
+}
+
+/* SetContent
+**    Sets the local and remote copies of the file being viewed, which may be
+** binary, and shows the differences in a way that suits the content. An
+** archive is compared as a listing of its contents.
+*/
+
+func (d *FileViewer) SetContent (local, remote string) {
+   kind := ContentKind(d.file, []byte(local), []byte(remote))
+   if kind == Content__Archive {
+      l, err1 := ArchiveListing([]byte(local))
+      r, err2 := ArchiveListing([]byte(remote))
+      if err1 == nil && err2 == nil { local, remote = l, r } else { kind = Content__Binary }
+   }
+   d.setContent(kind, local, remote)
+}
+
+/* SetResult
+**    Shows the files fetched by 'FetchView', using the differences computed
+** there (if any) while the texts are compared as they are.
+*/
+
+func (d *FileViewer) SetResult (r *ViewResult) {
+   d.SetPath(r.Path)
+   if r.Summary != nil { d.SetSummary(r.Summary); return }
+   d.pre = r
+   d.SetContent(r.Local, r.Remote)
+}
+
+/* SetSummary
+**    Shows a summary of the two copies of a file that is too large to
+** compare in full.
+*/
+
+func (d *FileViewer) SetSummary (sum *FileSummary) {
+   d.summary = sum
+   d.setContent(Content__Summary, "", "")
+}
+
+/* SetTexts
+**    Sets the local and remote copies of the (text) file being viewed and
+** shows the differences in the current mode. The 'ignore' options start out
+** the same as for the site, but may be changed for this view only. Each copy
+** is converted from its detected encoding, unless the user chooses another.
+*/
+
+func (d *FileViewer) SetTexts (local, remote string) {
+   d.setContent(Content__Text, local, remote)
+}
+
+func (d *FileViewer) setContent (kind int, local, remote string) {
+   d.kind, d.local, d.remote = kind, local, remote
+   if d.pre != nil && (d.pre.Local != local || d.pre.Remote != remote) { d.pre = nil }
+   for n, v := range []bool{
+      Config.Ignore.IgnoreTrailing, Config.Ignore.IgnoreSpace,
+      Config.Ignore.IgnoreBlank, Config.Ignore.IgnoreCase,
+   } {
+      d.ignore[n].BlockSignals(true)
+      d.ignore[n].SetChecked(v)
+      d.ignore[n].BlockSignals(false)
+   }
+   for n, text := range []string{local, remote} {
+      d.encoding[n].BlockSignals(true)
+      d.encoding[n].SetCurrentIndex(0)
+      d.encoding[n].SetItemText(0, "Auto (" + DetectEncoding([]byte(text)) + ")")
+      d.encoding[n].BlockSignals(false)
+   }
+   d.refresh()
+}
+
+/* texts
+**    Returns the local and remote copies, as compared: converted to UTF-8
+** from the chosen encodings.
+*/
+
+func (d *FileViewer) texts () (string, string) {
+   local := DecodeText([]byte(d.local), d.encodingOf(0, d.local))
+   remote := DecodeText([]byte(d.remote), d.encodingOf(1, d.remote))
+   return local, remote
+}
+
+/* ignoreOptions
+**    Returns the 'ignore' options that are currently checked.
+*/
+
+func (d *FileViewer) ignoreOptions () TextOptions {
+   return TextOptions{
+      IgnoreTrailing: d.ignore[0].IsChecked(),
+      IgnoreSpace:    d.ignore[1].IsChecked(),
+      IgnoreBlank:    d.ignore[2].IsChecked(),
+      IgnoreCase:     d.ignore[3].IsChecked(),
+   }
+}
+
+/* encodingOf
+**    Returns the encoding chosen for one side (0 = local, 1 = remote), or
+** the detected encoding if left as 'Auto'.
+*/
+
+func (d *FileViewer) encodingOf (n int, text string) string {
+   if k := d.encoding[n].CurrentIndex(); k > 0 { return Encodings[k - 1] }
+   return DetectEncoding([]byte(text))
+}
+
+/* refresh
+**    Recomputes and shows the differences, either inline or side by side.
+** Navigation between changes is only available side by side. Binary files
+** are always shown side by side (as hex) and images as pictures. Large text
+** files are always compared line by line.
+*/
+
+func (d *FileViewer) refresh () {
+   text := d.kind == Content__Text || d.kind == Content__Archive
+   large := len(d.local) > InlineLimit || len(d.remote) > InlineLimit
+   side := d.sideBySide.IsChecked() || d.kind == Content__Binary || large
+   d.sideBySide.SetEnabled(text && ! large)
+   d.collapse.SetEnabled(side && d.kind != Content__Image)
+   for _, cb := range d.ignore { cb.SetEnabled(text) }
+   for _, cb := range d.encoding { cb.SetEnabled(d.kind == Content__Text) }
+   d.save.SetEnabled(d.kind == Content__Text)
+   d.merge.SetEnabled(d.mergeBase() != nil)
+   d.current = 0
+   d.editable = false
+   
+   switch d.kind {
+      case Content__Summary:
+         d.text.SetHtml(d.summary.Html())
+         d.pages.SetCurrentIndex(0)
+         d.info.SetText("")
+         d.changes = 0
+         d.showChange(0)
+         return
+      case Content__Image:
+         d.showImages()
+         return
+      case Content__Binary:
+         rows := HexRows([]byte(d.local), []byte(d.remote))
+         if d.collapse.IsChecked() { rows = CollapseRows(rows, CollapseContext) }
+         d.showSides(rows, HexHtml, hexKey)
+         return
+   }
+   
+   local, remote := d.texts()
+   o := d.ignoreOptions()
+   if ! side {
+      if o.Any() { d.SetHtml(NormalCharDiff(local, remote, o)) } else {
+         d.SetHtml(d.charDiff(local, remote))
+      }
+      d.pages.SetCurrentIndex(0)
+      d.info.SetText(inlineKey)
+      d.changes = 0
+      d.showChange(0)
+      return
+   }
+   
+   // Blocks can only be applied when the texts are compared as they are,
+   // as otherwise the blocks do not match those in the files.
+   d.editable = d.kind == Content__Text && ! o.Any() && local == d.local && remote == d.remote &&
+      ! qMain.cache.Transient() && qMain.scanState == Scanner__Idle
+   
+   var rows []DiffRow
+   if o.Any() { rows = NormalRows(local, remote, o) } else {
+      rows = SideBySide(d.lineDiff(local, remote))
+   }
+   if d.collapse.IsChecked() { rows = CollapseRows(rows, CollapseContext) }
+   d.showSides(rows, SideHtml, sideKey)
+}
+
+/* charDiff, lineDiff
+**    Return the differences between two texts, using those computed in
+** advance when they are for the same texts.
+*/
+
+func (d *FileViewer) charDiff (local, remote string) []dmp.Diff {
+   if d.pre != nil && d.pre.Inline != nil && local == d.pre.LocalText && remote == d.pre.RemoteText {
+      return d.pre.Inline
+   }
+   return CharDiff(local, remote)
+}
+
+func (d *FileViewer) lineDiff (local, remote string) []dmp.Diff {
+   if d.pre != nil && d.pre.Lines != nil && local == d.pre.LocalText && remote == d.pre.RemoteText {
+      return d.pre.Lines
+   }
+   return LineDiff(local, remote)
+}
+
+/* showSides
+**    Shows a side-by-side comparison, using the given function to lay out
+** each side as rich text.
+*/
+
+func (d *FileViewer) showSides (rows []DiffRow, layout func ([]DiffRow, bool) (string, int), key string) {
+   text, n := layout(rows, true)
+   d.left.SetHtml(text)
+   text, _ = layout(rows, false)
+   d.right.SetHtml(text)
+   
+   d.pages.SetCurrentIndex(1)
+   d.info.SetText(key)
+   d.changes = n
+   d.showChange(0)
+}
+
+/* showImages
+**    Shows the local and remote copies of an image, with an overlay of the
+** pixels that differ.
+*/
+
+func (d *FileViewer) showImages () {
+   d.pages.SetCurrentIndex(2)
+   d.changes = 0
+   d.showChange(0)
+   
+   if err := CheckImageSize([]byte(d.local), []byte(d.remote)); err != nil {
+      for _, label := range d.images { label.SetText(err.Error()) }
+      d.info.SetText("")
+      return
+   }
+   for n, data := range []string{d.local, d.remote} {
+      pix := gui.NewQPixmap()
+      pix.LoadFromData([]byte(data), uint(len(data)), "", 0)
+      d.images[n].SetPixmap(pix)
+   }
+   
+   var overlay []byte
+   var count int
+   var err error
+   if d.pre != nil {
+      overlay, count, err = d.pre.Overlay, d.pre.Differ, d.pre.ImageErr
+   } else {
+      overlay, count, err = ImageDiff([]byte(d.local), []byte(d.remote))
+   }
+   if err != nil {
+      d.images[2].SetText(err.Error())
+      d.info.SetText("Left: local copy; centre: remote copy")
+      return
+   }
+   pix := gui.NewQPixmap()
+   pix.LoadFromData(overlay, uint(len(overlay)), "PNG", 0)
+   d.images[2].SetPixmap(pix)
+   d.info.SetText(fmt.Sprintf(imageKey, count))
+}
+
+/* showChange
+**    Scrolls both sides to the start of the given block of changes (if any)
+** and updates the navigation buttons.
+*/
+
+func (d *FileViewer) showChange (n int) {
+   if n >= 0 && n < d.changes {
+      d.current = n
+      anchor := fmt.Sprintf("c%d", n)
+      d.left.ScrollToAnchor(anchor)
+      d.right.ScrollToAnchor(anchor)
+   }
+   d.prev.SetEnabled(d.current > 0 && d.changes > 0)
+   d.next.SetEnabled(d.current < d.changes - 1)
+   d.push.SetEnabled(d.editable && d.changes > 0)
+   d.pull.SetEnabled(d.editable && d.changes > 0)
+}
+
+/* mergeBase
+**    Returns the cache entry for the file being viewed if it can be merged:
+** that is, if it is a text file changed on both sides, and a base copy was
+** kept. Otherwise returns nil.
+*/
+
+func (d *FileViewer) mergeBase () *FilePrint {
+   if d.kind != Content__Text || qMain.cache.Transient() || qMain.scanState != Scanner__Idle {
+      return nil
+   }
+   fp, ok := qMain.cache.FilePrints[d.file]
+   if ! ok || fp.Base == nil { return nil }
+   if ls, _ := Classify(fp); ls != State__Conflict { return nil }
+   return fp
+}
+
+/* openMerge
+**    Handles the 'merge' button. Opens the merge editor for a file changed
+** on both sides, and shows the result once saved.
+*/
+
+func (d *FileViewer) openMerge (bool) {
+   fp := d.mergeBase()
+   if fp == nil { return }
+   base, err := qMain.cache.LoadBase(fp)
+   if err != nil {
+      widgets.QMessageBox_Critical(
+         d, "Error", fmt.Sprintf("Merge: %v", err),
+         widgets.QMessageBox__Ok, widgets.QMessageBox__NoButton,
+      )
+      return
+   }
+   
+   editor := NewMergeEditor(d, 0)
+   editor.SetFiles(d.file, base, d.local, d.remote)
+   if editor.Exec() == int(widgets.QDialog__Accepted) {
+      local, remote := editor.Merged, d.remote
+      if editor.upload.IsChecked() { remote = editor.Merged }
+      d.setContent(Content__Text, local, remote)
+   }
+}
+
+/* applyHunk
+**    Handles the 'push' and 'pull' buttons. Applies the current block of
+** changes to the remote copy (push) or the local copy (pull), then updates
+** the fingerprint and the report.
+*/
+
+func (d *FileViewer) applyHunk (push bool) {
+   hunks := Hunks(d.local, d.remote)
+   if d.current >= len(hunks) { return }
+   h := &hunks[d.current]
+   
+   msg := "Replace these lines in the local copy with the remote version?"
+   if push { msg = "Replace these lines in the remote copy with the local version?" }
+   answer := widgets.QMessageBox_Question(
+      d, "Apply Changes", msg,
+      widgets.QMessageBox__Ok | widgets.QMessageBox__Cancel,
+      widgets.QMessageBox__NoButton,
+   )
+   if answer != widgets.QMessageBox__Ok { return }
+   
+   cache := qMain.cache
+   var err error
+   if push {
+      remote := h.Push(d.remote)
+      var conn FTPConn
+      conn, err = qMain.viewConnection()
+      if err == nil { err = StoreRemote(cache, conn, d.file, remote) }
+      if err == nil { d.remote = remote } else { qMain.closeView() }
+   } else {
+      local := h.Pull(d.local)
+      var src FTPConn
+      src, err = qMain.sourceConnection()
+      if err == nil { err = StoreLocal(cache, src, d.file, local) }
+      if err == nil { d.local = local } else { qMain.closeView() }
+   }
+   if err != nil {
+      widgets.QMessageBox_Critical(
+         d, "Error", fmt.Sprintf("Apply changes: %v", err),
+         widgets.QMessageBox__Ok, widgets.QMessageBox__NoButton,
+      )
+      return
+   }
+   
+   cache.Write()
+   qMain.report.SetModel(ShowResults(cache))
+   
+   // The next block (if any) now has the same number
+   n := d.current
+   d.refresh()
+   if n >= d.changes { n = d.changes - 1 }
+   d.showChange(n)
+}
+
 /* SetHtml
 **    Translates the differences between local and remote copies into a
 ** rich text (HTML) representation that highlights insertions and deletions.
 */
 
 func (d *FileViewer) SetHtml (diffs []dmp.Diff) {
+   d.text.SetHtml(DiffHtml(diffs))
+}
+
+/*---------------------------------------------------------------------------
+   DiffHtml
+      Returns the HTML representation of a set of differences, as shown in
+   the file viewer.
+---------------------------------------------------------------------------*/
+
+func DiffHtml (diffs []dmp.Diff) string {
    var buf strings.Builder
 	for _, d := range diffs {
 		text := strings.ReplaceAll(html.EscapeString(d.Text), "\n", "<br>")
@@ -127,5 +785,5 @@ func (d *FileViewer) SetHtml (diffs []dmp.Diff) {
 			buf.WriteString("</span>")
 		}
 	}
-   d.text.SetHtml(buf.String())
+   return buf.String()
 }
\ No newline at end of file
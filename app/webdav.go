@@ -0,0 +1,361 @@
+package app
+
+/*
+** This file contains the 'dav' and 'davs' schemes for the remote side, which
+** access the remote copy through WebDAV (over HTTP or HTTPS), as offered by many
+** hosting control panels. Folders are listed with PROPFIND, files are fetched
+** with GET and uploaded with PUT. Both basic and digest authentication are
+** supported.
+*/
+
+import (
+   "os"
+   "io"
+   "fmt"
+   "log"
+   "path"
+   "time"
+   "errors"
+   "strings"
+   "net/url"
+   "net/http"
+   "crypto/md5"
+   "crypto/rand"
+   "encoding/hex"
+   "encoding/xml"
+   "path/filepath"
+)
+
+// Properties requested when listing a folder
+const davPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop>
+<resourcetype/><getcontentlength/><getlastmodified/>
+</prop></propfind>`
+
+/*---------------------------------------------------------------------------
+   dialDAV
+      Helper function to create and return a WebDAV session (with or without
+   TLS). The remote folder is listed, to check the address and login.
+---------------------------------------------------------------------------*/
+
+func dialDAV (r *RemoteSide) (FTPConn, error) {
+   var err error
+   if Opt.Verbose { log.Println("Opening WebDAV session") }
+
+   user, pwd := r.Addr.User.Username(), ""
+   if user != "" {
+      pwd, err = r.getPassword()
+      if err != nil { return nil, err }
+   }
+
+   base := &url.URL{ Scheme: "http", Host: r.Addr.Host }
+   transport, err := newTransport(r.Site)
+   if err != nil { return nil, err }
+   if r.Addr.Scheme == "davs" {
+      base.Scheme = "https"
+      transport.TLSClientConfig, err = tlsConfig(r)
+      if err != nil { return nil, err }
+   }
+
+   conn := &DAVConn{
+      client:  &http.Client{ Transport: transport },
+      base:    base,
+      user:    user,
+      pwd:     pwd,
+   }
+   _, err = conn.ReadDir(r.Addr.Path)
+   if err != nil {
+      conn.Close(); return nil, err
+   }
+
+   return conn, nil
+}
+
+/*---------------------------------------------------------------------------
+   DAVConn [type]
+      Implements the same interface as an FTP connection, over WebDAV. The
+   authentication challenge from the server is kept, so that later requests
+   can be authorised without a further round trip.
+---------------------------------------------------------------------------*/
+
+type DAVConn struct {
+   client      *http.Client
+   base        *url.URL
+   user,
+   pwd         string
+   challenge   map[string]string    // parameters of the last challenge
+   digest      bool
+   count       int                  // nonce count, for digest
+}
+
+func (c *DAVConn) Close () error {
+   c.client.CloseIdleConnections()
+   return nil
+}
+
+func (c *DAVConn) ReadDir (dir string) ([]os.FileInfo, error) {
+   dir = strings.TrimSuffix(filepath.ToSlash(dir), "/") + "/"
+   header := http.Header{
+      "Depth":         []string{"1"},
+      "Content-Type":  []string{"application/xml; charset=utf-8"},
+   }
+   resp, err := c.do("PROPFIND", dir, header, strings.NewReader(davPropfind))
+   if err != nil { return nil, err }
+   defer resp.Body.Close()
+   if resp.StatusCode != http.StatusMultiStatus { return nil, davError(resp, dir) }
+
+   var ms davMultistatus
+   err = xml.NewDecoder(resp.Body).Decode(&ms)
+   if err != nil { return nil, err }
+
+   list := make([]os.FileInfo, 0, len(ms.Responses))
+   for _, r := range ms.Responses {
+      href, err := url.Parse(r.Href)
+      if err != nil { continue }
+      name := strings.TrimSuffix(href.Path, "/")
+      if name + "/" == dir || name == strings.TrimSuffix(dir, "/") { continue } // the folder itself
+
+      for _, ps := range r.Propstat {
+         if ! strings.Contains(ps.Status, " 200 ") { continue }
+         inf := &davFileInfo{
+            name:  path.Base(name),
+            size:  ps.Prop.Length,
+            dir:   ps.Prop.Type.Collection != nil,
+         }
+         inf.mtime, _ = http.ParseTime(ps.Prop.Modified)
+         list = append(list, inf)
+      }
+   }
+   return list, nil
+}
+
+func (c *DAVConn) Retrieve (path string, dest io.Writer) error {
+   path = filepath.ToSlash(path)
+   resp, err := c.do("GET", path, nil, nil)
+   if err != nil { return err }
+   defer resp.Body.Close()
+   if resp.StatusCode != http.StatusOK { return davError(resp, path) }
+
+   _, err = io.Copy(dest, resp.Body)
+   return err
+}
+
+func (c *DAVConn) Store (path string, src io.Reader) error {
+   path = filepath.ToSlash(path)
+   resp, err := c.do("PUT", path, nil, src)
+   if err != nil { return err }
+   defer resp.Body.Close()
+   switch resp.StatusCode {
+      case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+         return nil
+   }
+   return davError(resp, path)
+}
+
+/* do
+**    Sends a request, adding the authorisation for the last challenge (if
+** any). If the server asks for authorisation, the request is sent again,
+** provided the body can be re-read.
+*/
+
+func (c *DAVConn) do (method, path string, header http.Header, body io.Reader) (*http.Response, error) {
+   u := *c.base
+   u.Path = path
+
+   req, err := http.NewRequest(method, u.String(), body)
+   if err != nil { return nil, err }
+   for k, v := range header { req.Header[k] = v }
+   throttleRequest(req)
+
+   for retry := false; ; retry = true {
+      if c.challenge != nil { req.Header.Set("Authorization", c.authorise(method, u.RequestURI())) }
+
+      resp, err := c.client.Do(req)
+      if err != nil { return nil, err }
+      if resp.StatusCode != http.StatusUnauthorized || retry { return resp, nil }
+
+      resp.Body.Close()
+      // A second challenge means the login was refused, unless the nonce was stale
+      refused := c.challenge != nil && ! strings.EqualFold(parseChallenge(resp)["stale"], "true")
+      if ! c.setChallenge(resp) || refused {
+         return nil, errors.New("WebDAV login failed")
+      }
+      req = req.Clone(req.Context())
+      if body != nil {
+         if req.GetBody == nil { return nil, errors.New("WebDAV login needed before upload") }
+         req.Body, err = req.GetBody()
+         if err != nil { return nil, err }
+      }
+   }
+}
+
+// Uploads are limited by 'do', as the body may be sent twice
+func (c *DAVConn) throttlesUploads () {}
+
+/* setChallenge
+**    Keeps the details of an authentication challenge, preferring digest to
+** basic. Returns false if neither is offered.
+*/
+
+func (c *DAVConn) setChallenge (resp *http.Response) bool {
+   params := parseChallenge(resp)
+   if params == nil { return false }
+   c.challenge = params
+   c.digest = params["scheme"] == "digest"
+   c.count = 0
+   return true
+}
+
+/* authorise
+**    Returns the 'Authorization' header for a request, in answer to the last
+** challenge.
+*/
+
+func (c *DAVConn) authorise (method, uri string) string {
+   if ! c.digest {
+      req := http.Request{ Header: http.Header{} }
+      req.SetBasicAuth(c.user, c.pwd)
+      return req.Header.Get("Authorization")
+   }
+
+   ch := c.challenge
+   ha1 := md5hex(c.user + ":" + ch["realm"] + ":" + c.pwd)
+   ha2 := md5hex(method + ":" + uri)
+   auth := fmt.Sprintf(
+      `Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=MD5`,
+      c.user, ch["realm"], ch["nonce"], uri,
+   )
+   if qop := ch["qop"]; qop != "" {
+      c.count++
+      nc := fmt.Sprintf("%08x", c.count)
+      cnonce := make([]byte, 8)
+      rand.Read(cnonce)
+      cn := hex.EncodeToString(cnonce)
+      auth += fmt.Sprintf(
+         `, qop=auth, nc=%s, cnonce="%s", response="%s"`,
+         nc, cn, md5hex(ha1 + ":" + ch["nonce"] + ":" + nc + ":" + cn + ":auth:" + ha2),
+      )
+   } else {
+      auth += fmt.Sprintf(`, response="%s"`, md5hex(ha1 + ":" + ch["nonce"] + ":" + ha2))
+   }
+   if op, ok := ch["opaque"]; ok { auth += fmt.Sprintf(`, opaque="%s"`, op) }
+   return auth
+}
+
+/* parseChallenge
+**    Returns the parameters of the digest (or else basic) challenge in a
+** response, with the scheme in lower case under the key "scheme". Returns
+** nil if there is no supported challenge.
+*/
+
+func parseChallenge (resp *http.Response) map[string]string {
+   var basic map[string]string
+   for _, h := range resp.Header["Www-Authenticate"] {
+      parts := strings.SplitN(strings.TrimSpace(h), " ", 2)
+      scheme := strings.ToLower(parts[0])
+      switch scheme {
+         case "digest":
+            params := map[string]string{ "scheme": scheme }
+            if len(parts) > 1 { parseParams(parts[1], params) }
+            return params
+         case "basic":
+            basic = map[string]string{ "scheme": scheme }
+      }
+   }
+   return basic
+}
+
+/* parseParams
+**    Adds the comma-separated 'name=value' pairs of a challenge to a map.
+** Values may be quoted.
+*/
+
+func parseParams (text string, params map[string]string) {
+   for text != "" {
+      text = strings.TrimLeft(text, " ,")
+      eq := strings.IndexByte(text, '=')
+      if eq < 0 { return }
+      name := strings.ToLower(strings.TrimSpace(text[:eq]))
+      text = strings.TrimSpace(text[eq+1:])
+
+      var value string
+      if strings.HasPrefix(text, `"`) {
+         end := strings.IndexByte(text[1:], '"')
+         if end < 0 { end = len(text) - 1 }
+         value, text = text[1:end+1], text[minInt(end+2, len(text)):]
+      } else {
+         end := strings.IndexByte(text, ',')
+         if end < 0 { end = len(text) }
+         value, text = strings.TrimSpace(text[:end]), text[end:]
+      }
+      if name == "qop" {
+         // Only 'auth' is supported
+         for _, q := range strings.Split(value, ",") {
+            if strings.TrimSpace(q) == "auth" { value = "auth" }
+         }
+         if value != "auth" { value = "" }
+      }
+      params[name] = value
+   }
+}
+
+func md5hex (text string) string {
+   sum := md5.Sum([]byte(text))
+   return hex.EncodeToString(sum[:])
+}
+
+/* davError
+**    Returns an error for an unexpected response.
+*/
+
+func davError (resp *http.Response, path string) error {
+   return fmt.Errorf("WebDAV: %s (%s)", resp.Status, path)
+}
+
+/*---------------------------------------------------------------------------
+   davMultistatus [type]
+      Parts of a PROPFIND response used in listing a folder.
+---------------------------------------------------------------------------*/
+
+type davMultistatus struct {
+   Responses   []davResponse        `xml:"DAV: response"`
+}
+
+type davResponse struct {
+   Href        string               `xml:"DAV: href"`
+   Propstat    []davPropstat        `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+   Status      string               `xml:"DAV: status"`
+   Prop        struct {
+      Length      int64             `xml:"DAV: getcontentlength"`
+      Modified    string            `xml:"DAV: getlastmodified"`
+      Type        struct {
+         Collection  *struct{}      `xml:"DAV: collection"`
+      }                             `xml:"DAV: resourcetype"`
+   }                                `xml:"DAV: prop"`
+}
+
+/*---------------------------------------------------------------------------
+   davFileInfo [type]
+      Details of a remote file, as listed by PROPFIND.
+---------------------------------------------------------------------------*/
+
+type davFileInfo struct {
+   name        string
+   size        int64
+   mtime       time.Time
+   dir         bool
+}
+
+func (f *davFileInfo) Name () string { return f.name }
+func (f *davFileInfo) Size () int64 { return f.size }
+func (f *davFileInfo) ModTime () time.Time { return f.mtime }
+func (f *davFileInfo) IsDir () bool { return f.dir }
+func (f *davFileInfo) Sys () interface{} { return nil }
+
+func (f *davFileInfo) Mode () os.FileMode {
+   if f.dir { return os.ModeDir | 0755 }
+   return 0644
+}
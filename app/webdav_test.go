@@ -0,0 +1,243 @@
+package app
+
+import (
+   "os"
+   "io"
+   "fmt"
+   "strings"
+   "testing"
+   "net/url"
+   "net/http"
+   "io/ioutil"
+   "path/filepath"
+   "net/http/httptest"
+)
+
+/*---------------------------------------------------------------------------
+   davFolder [type]
+      Test handler that serves a folder with just the requests used by the
+   client: PROPFIND (depth 1), GET and PUT.
+---------------------------------------------------------------------------*/
+
+type davFolder string
+
+func (d davFolder) ServeHTTP (w http.ResponseWriter, r *http.Request) {
+   path := filepath.Join(string(d), filepath.FromSlash(r.URL.Path))
+   switch r.Method {
+      case "PROPFIND": {
+         info, err := os.Stat(path)
+         if err != nil { http.NotFound(w, r); return }
+         w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+         w.WriteHeader(http.StatusMultiStatus)
+         fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">`)
+         davEntry(w, r.URL.Path, info)
+         if info.IsDir() {
+            list, _ := ioutil.ReadDir(path)
+            for _, info := range list {
+               davEntry(w, strings.TrimSuffix(r.URL.Path, "/") + "/" + info.Name(), info)
+            }
+         }
+         fmt.Fprint(w, `</D:multistatus>`)
+      }
+      case "GET": {
+         f, err := os.Open(path)
+         if err != nil { http.NotFound(w, r); return }
+         defer f.Close()
+         io.Copy(w, f)
+      }
+      case "PUT": {
+         data, err := ioutil.ReadAll(r.Body)
+         if err == nil { err = ioutil.WriteFile(path, data, 0644) }
+         if err != nil { http.Error(w, err.Error(), http.StatusConflict); return }
+         w.WriteHeader(http.StatusCreated)
+      }
+      default:
+         http.Error(w, "Not allowed", http.StatusMethodNotAllowed)
+   }
+}
+
+/* davEntry
+**    Writes the PROPFIND response for one file or folder.
+*/
+
+func davEntry (w io.Writer, path string, info os.FileInfo) {
+   href, kind := (&url.URL{ Path: path }).EscapedPath(), ""
+   if info.IsDir() { href, kind = strings.TrimSuffix(href, "/") + "/", "<D:collection/>" }
+   fmt.Fprintf(
+      w,
+      "<D:response><D:href>%s</D:href><D:propstat><D:prop>" +
+      "<D:resourcetype>%s</D:resourcetype><D:getcontentlength>%d</D:getcontentlength>" +
+      "<D:getlastmodified>%s</D:getlastmodified></D:prop>" +
+      "<D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>",
+      href, kind, info.Size(), info.ModTime().UTC().Format(http.TimeFormat),
+   )
+}
+
+/*---------------------------------------------------------------------------
+   digestAuth [type]
+      Test handler that requires digest authentication (RFC 2617, with
+   'qop=auth') before passing each request on. Basic is offered as well, to
+   check that digest is preferred.
+---------------------------------------------------------------------------*/
+
+type digestAuth struct {
+   handler     http.Handler
+   user,
+   pwd         string
+   challenges  int
+}
+
+const testRealm, testNonce = "ftpsync test", "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+
+func (d *digestAuth) ServeHTTP (w http.ResponseWriter, r *http.Request) {
+   params := map[string]string{}
+   if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Digest ") {
+      parseParams(h[len("Digest "):], params)
+   }
+   ha1 := md5hex(d.user + ":" + testRealm + ":" + d.pwd)
+   ha2 := md5hex(r.Method + ":" + params["uri"])
+   want := md5hex(ha1 + ":" + testNonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+
+   if params["username"] != d.user || params["nonce"] != testNonce || params["qop"] != "auth" ||
+      params["uri"] != r.URL.RequestURI() || params["response"] != want || params["opaque"] != "5ccc" {
+      d.challenges++
+      w.Header().Add("WWW-Authenticate", `Basic realm="` + testRealm + `"`)
+      w.Header().Add("WWW-Authenticate", fmt.Sprintf(
+         `Digest realm="%s", qop="auth,auth-int", nonce="%s", opaque="5ccc", algorithm=MD5`,
+         testRealm, testNonce,
+      ))
+      http.Error(w, "Unauthorized", http.StatusUnauthorized)
+      return
+   }
+   d.handler.ServeHTTP(w, r)
+}
+
+/* davServer
+**    Starts a WebDAV server for a temporary folder, and makes it the remote
+** copy for the current site. The returned function stops the server, removes
+** the folder and restores the site.
+*/
+
+func davServer (t *testing.T, pwd string) (string, *digestAuth, func ()) {
+   dir := tempDir(t)
+   auth := &digestAuth{ handler: davFolder(dir), user: "user", pwd: "secret" }
+   srv := httptest.NewServer(auth)
+
+   addr, _ := url.Parse(srv.URL)
+   addr.Scheme = "dav"
+   addr.User = url.UserPassword("user", pwd)
+   addr.Path = "/site"
+
+   saved := Config
+   Config = &SiteConfig{ RemoteAddr: addr }
+   return dir, auth, func () { srv.Close(); os.RemoveAll(dir); Config = saved }
+}
+
+func TestDAVConn (t *testing.T) {
+   dir, auth, done := davServer(t, "secret")
+   defer done()
+   writeFiles(t, dir, map[string]string{
+      "site/index.html":    "<p>hello</p>\n",
+      "site/css/site.css":  "p {}\n",
+   })
+
+   conn, err := dialDAV(Config.remoteSide())
+   if err != nil { t.Fatal(err) }
+   defer conn.Close()
+
+   // PROPFIND
+   list, err := conn.ReadDir("/site")
+   if err != nil { t.Fatal(err) }
+   found := map[string]bool{}
+   for _, info := range list {
+      found[info.Name()] = true
+      switch info.Name() {
+         case "index.html":
+            if info.IsDir() || info.Size() != 13 || info.ModTime().IsZero() {
+               t.Errorf("index.html: dir %v, size %d, time %v", info.IsDir(), info.Size(), info.ModTime())
+            }
+         case "css":
+            if ! info.IsDir() { t.Errorf("css: not a folder") }
+      }
+   }
+   if len(list) != 2 || ! found["index.html"] || ! found["css"] { t.Errorf("listing: got %v", found) }
+
+   // GET
+   var buf strings.Builder
+   if err = conn.Retrieve("/site/css/site.css", &buf); err != nil { t.Fatal(err) }
+   if buf.String() != "p {}\n" { t.Errorf("GET: got %q", buf.String()) }
+   if err = conn.Retrieve("/site/none.html", &buf); err == nil { t.Errorf("GET: no error for missing file") }
+
+   // PUT
+   if err = conn.Store("/site/new file.txt", strings.NewReader("new\n")); err != nil { t.Fatal(err) }
+   data, err := ioutil.ReadFile(filepath.Join(dir, "site", "new file.txt"))
+   if err != nil || string(data) != "new\n" { t.Errorf("PUT: got %q, %v", data, err) }
+
+   // Only the first request should have been challenged
+   if auth.challenges != 1 { t.Errorf("got %d challenges, want 1", auth.challenges) }
+}
+
+func TestDAVLoginFailed (t *testing.T) {
+   _, _, done := davServer(t, "wrong")
+   defer done()
+   if _, err := dialDAV(Config.remoteSide()); err == nil || ! strings.Contains(err.Error(), "401") {
+      t.Errorf("got %v, want login failure", err)
+   }
+}
+
+func TestParseChallenge (t *testing.T) {
+   tests := []struct {
+      headers     []string
+      want        map[string]string
+   }{
+      { []string{`Basic realm="x"`, `Digest realm="a b", nonce="n,1", qop="auth-int, auth", stale=TRUE`},
+         map[string]string{ "scheme": "digest", "realm": "a b", "nonce": "n,1", "qop": "auth", "stale": "TRUE" } },
+      { []string{`Digest realm=r, nonce=n, qop="auth-int"`},
+         map[string]string{ "scheme": "digest", "realm": "r", "nonce": "n", "qop": "" } },
+      { []string{`basic realm="x"`}, map[string]string{ "scheme": "basic" } },
+      { []string{`Bearer realm="x"`}, nil },
+      { nil, nil },
+   }
+   for n, test := range tests {
+      resp := &http.Response{ Header: http.Header{ "Www-Authenticate": test.headers } }
+      got := parseChallenge(resp)
+      if fmt.Sprint(got) != fmt.Sprint(test.want) { t.Errorf("%d: got %v, want %v", n, got, test.want) }
+   }
+}
+
+func TestAuthorise (t *testing.T) {
+   // Digest without 'qop', from the example in RFC 2069
+   c := &DAVConn{ user: "Mufasa", pwd: "CircleOfLife", digest: true, challenge: map[string]string{
+      "realm": "testrealm@host.com", "nonce": "dcd98b7102dd2f0e8b11d0f600bfb0c093", "opaque": "5ccc069c403ebaf9f0171e9517f40e41",
+   }}
+   auth := c.authorise("GET", "/dir/index.html")
+   params := map[string]string{}
+   parseParams(strings.TrimPrefix(auth, "Digest "), params)
+   if params["response"] != "1949323746fe6a43ef61f9606e7febea" || params["opaque"] != c.challenge["opaque"] {
+      t.Errorf("digest: got %s", auth)
+   }
+
+   c = &DAVConn{ user: "user", pwd: "pass", challenge: map[string]string{ "scheme": "basic" } }
+   if got := c.authorise("GET", "/"); got != "Basic dXNlcjpwYXNz" { t.Errorf("basic: got %s", got) }
+}
+
+func TestDAVUploadAfterChallenge (t *testing.T) {
+   // An upload that meets a challenge must be sent again in full, even with
+   // the bandwidth limited
+   dir, auth, done := davServer(t, "secret")
+   defer done()
+   writeFiles(t, dir, map[string]string{ "site/index.html": "" })
+
+   conn, err := DialRemote()
+   if err != nil { t.Fatal(err) }
+   defer conn.Close()
+   Throttle.SetRate(4096)
+   defer Throttle.SetRate(0)
+
+   conn.(throttledConn).FTPConn.(*DAVConn).challenge = nil
+   text := strings.Repeat("0123456789abcdef", 1024)
+   if err = conn.Store("/site/index.html", strings.NewReader(text)); err != nil { t.Fatal(err) }
+   data, err := ioutil.ReadFile(filepath.Join(dir, "site", "index.html"))
+   if err != nil || string(data) != text { t.Errorf("PUT: got %d bytes, %v", len(data), err) }
+   if auth.challenges != 2 { t.Errorf("got %d challenges, want 2", auth.challenges) }
+}
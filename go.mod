@@ -15,3 +15,5 @@ require (
 	github.com/therecipe/qt/internal/binding/files/docs/5.13.0 v0.0.0-20200904063919-c0c124a5770d // indirect
 	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
 )
+
+replace github.com/secsy/goftp => ./third_party/goftp
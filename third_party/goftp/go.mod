@@ -0,0 +1,3 @@
+module github.com/secsy/goftp
+
+go 1.13